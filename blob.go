@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// BlobAPI downloads message content from LINE
+type BlobAPI interface {
+	GetMessageContent(ctx context.Context, messageID string) (*BlobContent, error)
+	// GetTranscodingStatus reports whether video or audio content is ready:
+	// "processing", "succeeded" or "failed"
+	GetTranscodingStatus(ctx context.Context, messageID string) (string, error)
+}
+
+// BlobContent is a downloaded message body along with the metadata the
+// server sent for it. The caller must close it.
+type BlobContent struct {
+	io.ReadCloser
+	ContentType   string
+	ContentLength int64
+}
+
+type realBlobAPI struct {
+	api *messaging_api.MessagingApiBlobAPI
+}
+
+// GetMessageContent builds the request itself instead of using the SDK call
+// so that ctx is attached per download; the SDK's WithContext mutates the
+// shared client and is not safe for concurrent use.
+func (r *realBlobAPI) GetMessageContent(ctx context.Context, messageID string) (*BlobContent, error) {
+	endpoint := r.api.Url(fmt.Sprintf("/v2/bot/message/%s/content", url.PathEscape(messageID)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.api.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected status code: %d, %s", resp.StatusCode, string(body))
+	}
+	return &BlobContent{
+		ReadCloser:    resp.Body,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: resp.ContentLength,
+	}, nil
+}
+
+func (r *realBlobAPI) GetTranscodingStatus(ctx context.Context, messageID string) (string, error) {
+	endpoint := r.api.Url(fmt.Sprintf("/v2/bot/message/%s/content/transcoding", url.PathEscape(messageID)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := r.api.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("unexpected status code: %d, %s", resp.StatusCode, string(body))
+	}
+	var result messaging_api.GetMessageContentTranscodingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode transcoding status: %v", err)
+	}
+	return string(result.Status), nil
+}
+
+// newBlobAPI creates the LINE content client once at startup
+func newBlobAPI(config *Config) (BlobAPI, error) {
+	httpClient, err := newBlobHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	api, err := messaging_api.NewMessagingApiBlobAPI(config.LineChannelToken,
+		messaging_api.WithBlobHTTPClient(httpClient))
+	if err != nil {
+		return nil, err
+	}
+	return &realBlobAPI{api: api}, nil
+}
+
+// newBlobHTTPClient builds a pooled HTTP client with the configured timeouts
+// and proxy for content downloads.
+func newBlobHTTPClient(config *Config) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if config.BlobProxyURL != "" {
+		proxyURL, err := url.Parse(config.BlobProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LINE_BLOB_PROXY: %v", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          config.BlobMaxIdleConns,
+		MaxIdleConnsPerHost:   config.BlobMaxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: config.BlobHeaderTimeout,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.BlobTimeout,
+	}, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+func newTestBlobAPI(t *testing.T, handler http.HandlerFunc) BlobAPI {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	api, err := messaging_api.NewMessagingApiBlobAPI("test-token",
+		messaging_api.WithBlobEndpoint(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &realBlobAPI{api: api}
+}
+
+func TestRealBlobAPIGetMessageContent(t *testing.T) {
+	blob := newTestBlobAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/bot/message/msg-1/content":
+			w.Write([]byte("content"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"Not found"}`))
+		}
+	})
+
+	content, err := blob.GetMessageContent(context.Background(), "msg-1")
+	if err != nil {
+		t.Fatalf("GetMessageContent() error: %v", err)
+	}
+	data, _ := io.ReadAll(content)
+	content.Close()
+	if string(data) != "content" {
+		t.Errorf("GetMessageContent() = %q, want %q", data, "content")
+	}
+
+	if _, err := blob.GetMessageContent(context.Background(), "missing"); err == nil {
+		t.Error("Expected error for missing content")
+	}
+}
+
+func TestRealBlobAPIHonorsContext(t *testing.T) {
+	blob := newTestBlobAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := blob.GetMessageContent(ctx, "msg-1"); err == nil {
+		t.Error("Expected error when context is cancelled")
+	}
+}
+
+func TestRealBlobAPIGetTranscodingStatus(t *testing.T) {
+	blob := newTestBlobAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/bot/message/vid-1/content/transcoding":
+			w.Write([]byte(`{"status":"processing"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	status, err := blob.GetTranscodingStatus(context.Background(), "vid-1")
+	if err != nil {
+		t.Fatalf("GetTranscodingStatus() error: %v", err)
+	}
+	if status != "processing" {
+		t.Errorf("GetTranscodingStatus() = %q, want processing", status)
+	}
+
+	if _, err := blob.GetTranscodingStatus(context.Background(), "missing"); err == nil {
+		t.Error("Expected error for missing message")
+	}
+}
+
+func TestNewBlobHTTPClient(t *testing.T) {
+	config := &Config{
+		BlobTimeout:       time.Minute,
+		BlobHeaderTimeout: 5 * time.Second,
+		BlobMaxIdleConns:  4,
+		BlobProxyURL:      "http://proxy.local:8080",
+	}
+
+	client, err := newBlobHTTPClient(config)
+	if err != nil {
+		t.Fatalf("newBlobHTTPClient() error: %v", err)
+	}
+	if client.Timeout != time.Minute {
+		t.Errorf("Timeout = %v, want 1m", client.Timeout)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 4 || transport.ResponseHeaderTimeout != 5*time.Second {
+		t.Errorf("Transport not configured: %+v", transport)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://api-data.line.me/", nil)
+	proxyURL, err := transport.Proxy(req)
+	if err != nil || proxyURL == nil || proxyURL.Host != "proxy.local:8080" {
+		t.Errorf("Proxy = %v, %v; want proxy.local:8080", proxyURL, err)
+	}
+
+	config.BlobProxyURL = "://bad"
+	if _, err := newBlobHTTPClient(config); err == nil {
+		t.Error("Expected error for invalid proxy URL")
+	}
+}
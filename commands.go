@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// permission is who may run a command
+type permission int
+
+const (
+	permissionEveryone permission = iota
+	permissionAdmin               // users listed in ADMIN_USERS
+)
+
+// argKind is what a command argument must look like
+type argKind int
+
+const (
+	argPeriod  argKind = iota // a period like 7d, 24h or 2w
+	argCommand                // the name or an alias of a command
+)
+
+// commandArg declares an argument of a command
+type commandArg struct {
+	Name     string
+	Kind     argKind
+	Help     string // catalog key
+	Optional bool
+}
+
+// command is an entry of the command registry. /help is generated from it.
+type command struct {
+	Name       string
+	Aliases    []string
+	Args       []commandArg
+	Help       string // catalog key
+	Permission permission
+	Run        func(c *commandContext)
+}
+
+// commandContext is a command being run, with its arguments checked against
+// the command's Args
+type commandContext struct {
+	bot        MessageSender
+	groupCache *GroupCache
+	userID     string
+	groupID    string
+	replyToken string
+	locale     string
+	admin      bool
+	args       []string
+}
+
+// arg returns the i-th argument, or "" when it was left out
+func (c *commandContext) arg(i int) string {
+	if i < len(c.args) {
+		return c.args[i]
+	}
+	return ""
+}
+
+// commands is the command registry, in the order /help lists them. It is
+// filled in init because /help refers to it.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			Name:    "help",
+			Aliases: []string{"h", "commands"},
+			Args:    []commandArg{{Name: "command", Kind: argCommand, Help: msgArgCommand, Optional: true}},
+			Help:    msgHelpHelp,
+			Run:     runHelp,
+		},
+		{
+			Name:    "stats",
+			Aliases: []string{"stat", "statistics"},
+			Args:    []commandArg{{Name: "period", Kind: argPeriod, Help: msgArgPeriod, Optional: true}},
+			Help:    msgHelpStats,
+			Run:     runStats,
+		},
+		{
+			Name:    "upload",
+			Aliases: []string{"howto"},
+			Help:    msgHelpUpload,
+			Run: func(c *commandContext) {
+				sendMessage(c.bot, c.replyToken, tr(c.locale, msgUploadHelp))
+			},
+		},
+	}
+}
+
+// findCommand looks up a command by name or alias, ignoring case and a
+// leading slash
+func findCommand(name string) *command {
+	name = strings.ToLower(strings.TrimPrefix(name, "/"))
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+		for _, alias := range cmd.Aliases {
+			if alias == name {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+// usage shows how to call the command, e.g. "/stats [period]"
+func (cmd *command) usage() string {
+	usage := "/" + cmd.Name
+	for _, arg := range cmd.Args {
+		if arg.Optional {
+			usage += " [" + arg.Name + "]"
+		} else {
+			usage += " <" + arg.Name + ">"
+		}
+	}
+	return usage
+}
+
+// checkArgs rejects too few or too many arguments and arguments of the
+// wrong kind
+func (cmd *command) checkArgs(args []string) error {
+	if len(args) > len(cmd.Args) {
+		return fmt.Errorf("too many arguments")
+	}
+	for i, arg := range cmd.Args {
+		if i >= len(args) {
+			if !arg.Optional {
+				return fmt.Errorf("missing %s", arg.Name)
+			}
+			continue
+		}
+		switch arg.Kind {
+		case argPeriod:
+			if _, err := parsePeriod(args[i]); err != nil {
+				return err
+			}
+		case argCommand:
+			if findCommand(args[i]) == nil {
+				return fmt.Errorf("unknown command %q", args[i])
+			}
+		}
+	}
+	return nil
+}
+
+// describe explains the command in detail for "/help <command>" and after a
+// wrong call
+func (cmd *command) describe(locale string) string {
+	lines := []string{tr(locale, msgUsage) + ": " + cmd.usage(), tr(locale, cmd.Help)}
+	for _, arg := range cmd.Args {
+		lines = append(lines, arg.Name+": "+tr(locale, arg.Help))
+	}
+	if len(cmd.Aliases) > 0 {
+		aliases := make([]string, len(cmd.Aliases))
+		for i, alias := range cmd.Aliases {
+			aliases[i] = "/" + alias
+		}
+		lines = append(lines, tr(locale, msgAliases)+": "+strings.Join(aliases, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parsePeriod reads a period argument: a number of days (d) or weeks (w).
+// Uploads are counted per day, so periods are whole days and no longer than
+// the days that are kept.
+func parsePeriod(s string) (time.Duration, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid period %q", s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n <= 0 || n > dailyStatsDays {
+		return 0, fmt.Errorf("invalid period %q", s)
+	}
+	days := n
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "d":
+	case "w":
+		days = n * 7
+	default:
+		return 0, fmt.Errorf("invalid period %q", s)
+	}
+	if days > dailyStatsDays {
+		return 0, fmt.Errorf("invalid period %q: at most %d days", s, dailyStatsDays)
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// commandText returns the command in a text message, if it is one: text
+// starting with "/", or text that starts by @mentioning the bot. Mentions of
+// the bot are removed, and a slash is added when it was left out.
+func commandText(message webhook.TextMessageContent) (string, bool) {
+	text := message.Text
+	addressed := false
+	if message.Mention != nil {
+		var self []webhook.UserMentionee
+		for _, m := range message.Mention.Mentionees {
+			switch m := m.(type) {
+			case webhook.UserMentionee:
+				if m.IsSelf {
+					self = append(self, m)
+				}
+			case *webhook.UserMentionee:
+				if m.IsSelf {
+					self = append(self, *m)
+				}
+			}
+		}
+		// Mention positions count UTF-16 code units; cut from the back so
+		// the earlier positions stay valid
+		sort.Slice(self, func(i, j int) bool { return self[i].Index > self[j].Index })
+		units := utf16.Encode([]rune(text))
+		for _, m := range self {
+			start, end := int(m.Index), int(m.Index+m.Length)
+			if start < 0 || end > len(units) || start > end {
+				continue
+			}
+			if strings.TrimSpace(string(utf16.Decode(units[:start]))) == "" {
+				addressed = true
+			}
+			units = append(units[:start:start], units[end:]...)
+		}
+		text = string(utf16.Decode(units))
+	}
+
+	text = strings.TrimSpace(text)
+	switch {
+	case strings.HasPrefix(text, "/"):
+		return text, true
+	case !addressed:
+		return "", false
+	case text == "":
+		// A bare mention asks what the bot can do
+		return "/help", true
+	}
+	return "/" + text, true
+}
+
+// handleCommand runs a command from userID in locale. admin tells whether the
+// sender is listed in ADMIN_USERS.
+func handleCommand(bot MessageSender, text, userID, groupID, replyToken string, groupCache *GroupCache, locale string, admin bool) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return
+	}
+
+	cmd := findCommand(fields[0])
+	if cmd == nil {
+		sendMessage(bot, replyToken, tr(locale, msgUnknownCommand))
+		return
+	}
+	if cmd.Permission == permissionAdmin && !admin {
+		sendMessage(bot, replyToken, fmt.Sprintf(tr(locale, msgAdminOnly), "/"+cmd.Name))
+		return
+	}
+	args := fields[1:]
+	if err := cmd.checkArgs(args); err != nil {
+		log.Printf("Invalid arguments for /%s: %v", cmd.Name, err)
+		sendMessage(bot, replyToken, cmd.describe(locale))
+		return
+	}
+
+	cmd.Run(&commandContext{
+		bot:        bot,
+		groupCache: groupCache,
+		userID:     userID,
+		groupID:    groupID,
+		replyToken: replyToken,
+		locale:     locale,
+		admin:      admin,
+		args:       args,
+	})
+}
+
+// helpText lists the commands the sender may run
+func helpText(locale string, admin bool) string {
+	lines := []string{tr(locale, msgHelpIntro), "", tr(locale, msgAvailableCommands)}
+	for _, cmd := range commands {
+		if cmd.Permission == permissionAdmin && !admin {
+			continue
+		}
+		lines = append(lines, cmd.usage()+" - "+tr(locale, cmd.Help))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func runHelp(c *commandContext) {
+	if name := c.arg(0); name != "" {
+		sendMessage(c.bot, c.replyToken, findCommand(name).describe(c.locale))
+		return
+	}
+	sendMessage(c.bot, c.replyToken, helpText(c.locale, c.admin))
+}
+
+func runStats(c *commandContext) {
+	summary := statsSummary{}
+	var since time.Time
+	if period := c.arg(0); period != "" {
+		d, _ := parsePeriod(period)
+		since = time.Now().Add(-d)
+		summary.Period = period
+	}
+
+	// Only admins see the uploads of every chat; anyone else messaging the
+	// bot directly sees their own
+	global := c.groupID == "" && c.admin
+	if global {
+		summary.Uploads, summary.LastUpload, summary.RecentFiles = c.groupCache.GetGlobalStats()
+		if summary.Period != "" {
+			summary.PeriodUploads = c.groupCache.GlobalUploadsSince(since)
+		}
+	} else {
+		key := chatKey(c.userID, c.groupID)
+		summary.Uploads, summary.LastUpload, summary.RecentFiles = c.groupCache.GetStats(key)
+		summary.FolderID = c.groupCache.Folder(key)
+		if summary.Period != "" {
+			summary.PeriodUploads = c.groupCache.UploadsSince(key, since)
+		}
+	}
+
+	if summary.Period != "" {
+		var recent []FileInfo
+		for _, file := range summary.RecentFiles {
+			if !file.Timestamp.Before(since) {
+				recent = append(recent, file)
+			}
+		}
+		summary.RecentFiles = recent
+	}
+
+	switch {
+	case isRoomID(c.groupID):
+		summary.Title = tr(c.locale, msgStatsRoom)
+	case c.groupID != "":
+		summary.Title = tr(c.locale, msgStatsGroup)
+	case global:
+		summary.Title = tr(c.locale, msgStatsAll)
+	default:
+		summary.Title = tr(c.locale, msgStatsChat)
+	}
+
+	// Clients that cannot render the card show its text instead
+	if err := replyMessages(c.bot, c.replyToken, statsCard(c.locale, summary)); err != nil {
+		log.Printf("Error sending stats card, sending text instead: %v", err)
+		sendMessage(c.bot, c.replyToken, summary.text(c.locale))
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+func lastSent(t *testing.T, bot *mockBot) string {
+	t.Helper()
+	if len(bot.sentMessages) == 0 {
+		t.Fatal("No message was sent")
+	}
+	return bot.sentMessages[len(bot.sentMessages)-1]
+}
+
+func TestCommandsIgnoreCaseAndAcceptAliases(t *testing.T) {
+	groupCache := NewGroupCache()
+	groupCache.AddUploadedFile("group-1", "a.jpg", "")
+
+	for _, text := range []string{"/Stats", "/STAT", "/statistics"} {
+		bot := newMockBot()
+		handleCommand(bot, text, "", "group-1", "reply-token", groupCache, localeEnglish, false)
+		if got := lastSent(t, bot); !strings.Contains(got, "Total uploads: 1") {
+			t.Errorf("%s = %q, want the stats", text, got)
+		}
+	}
+}
+
+func TestStatsPeriod(t *testing.T) {
+	groupCache := NewGroupCache()
+	groupCache.AddUploadedFile("group-1", "a.jpg", "")
+	groupCache.AddUploadedFile("group-1", "b.jpg", "")
+	// An upload from long ago still counts in the total only
+	groupCache.stats["group-1"].Daily[time.Now().AddDate(0, 0, -40).Format("2006-01-02")] = 3
+	groupCache.stats["group-1"].TotalUploads += 3
+
+	bot := newMockBot()
+	handleCommand(bot, "/stats 30d", "", "group-1", "reply-token", groupCache, localeEnglish, false)
+	got := lastSent(t, bot)
+	if !strings.Contains(got, "Total uploads: 5") || !strings.Contains(got, "Uploads in the last 30d: 2") {
+		t.Errorf("/stats 30d = %q, want 5 in total and 2 in the period", got)
+	}
+
+	handleCommand(bot, "/stats", "", "", "reply-token", groupCache, localeEnglish, false)
+	if got := lastSent(t, bot); strings.Contains(got, "Uploads in the last") {
+		t.Errorf("/stats = %q, want no period line", got)
+	}
+}
+
+func TestDirectStatsShowOnlyTheSender(t *testing.T) {
+	groupCache := NewGroupCache()
+	groupCache.AddUploadedFile("group-1", "secret.jpg", "https://drive.google.com/file/d/secret/view")
+	groupCache.AddUploadedFile("user-1", "mine.jpg", "")
+	groupCache.SetFolder("user-1", "folder-1")
+
+	bot := newMockBot()
+	handleCommand(bot, "/stats", "user-1", "", "reply-token", groupCache, localeEnglish, false)
+	got := lastSent(t, bot)
+	if !strings.Contains(got, "📊 Your Statistics") || !strings.Contains(got, "Total uploads: 1") || !strings.Contains(got, "mine.jpg") {
+		t.Errorf("/stats = %q, want the sender's own stats", got)
+	}
+	if strings.Contains(got, "secret") {
+		t.Errorf("/stats = %q, shows another chat's uploads", got)
+	}
+
+	handleCommand(bot, "/stats", "admin-1", "", "reply-token", groupCache, localeEnglish, true)
+	if got := lastSent(t, bot); !strings.Contains(got, "Total uploads: 2") {
+		t.Errorf("admin /stats = %q, want every chat", got)
+	}
+}
+
+func TestInvalidArgumentsShowUsage(t *testing.T) {
+	groupCache := NewGroupCache()
+	for _, text := range []string{"/stats soon", "/stats 24h", "/stats 7d 2w", "/upload now", "/help nope"} {
+		bot := newMockBot()
+		handleCommand(bot, text, "", "group-1", "reply-token", groupCache, localeEnglish, false)
+		if got := lastSent(t, bot); !strings.HasPrefix(got, "Usage: /") {
+			t.Errorf("%s = %q, want the usage", text, got)
+		}
+	}
+}
+
+func TestHelpForOneCommand(t *testing.T) {
+	bot := newMockBot()
+	handleCommand(bot, "/help stats", "", "", "reply-token", NewGroupCache(), localeEnglish, false)
+	got := lastSent(t, bot)
+	for _, want := range []string{"Usage: /stats [period]", "period: ", "Also: /stat, /statistics"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("/help stats = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	ran := false
+	commands = append(commands, &command{
+		Name:       "purge",
+		Help:       msgHelpUpload,
+		Permission: permissionAdmin,
+		Run:        func(*commandContext) { ran = true },
+	})
+	t.Cleanup(func() { commands = commands[:len(commands)-1] })
+
+	bot := newMockBot()
+	handleCommand(bot, "/purge", "", "", "reply-token", NewGroupCache(), localeEnglish, false)
+	if ran || lastSent(t, bot) != "Sorry, only admins can use /purge." {
+		t.Errorf("non-admin ran /purge or got %q", lastSent(t, bot))
+	}
+	if strings.Contains(helpText(localeEnglish, false), "/purge") {
+		t.Error("/help lists admin commands to everyone")
+	}
+
+	handleCommand(bot, "/purge", "", "", "reply-token", NewGroupCache(), localeEnglish, true)
+	if !ran {
+		t.Error("admin could not run /purge")
+	}
+	if !strings.Contains(helpText(localeEnglish, true), "/purge") {
+		t.Error("/help does not list admin commands to admins")
+	}
+}
+
+func TestCommandText(t *testing.T) {
+	mention := func(index, length int32, self bool) *webhook.Mention {
+		return &webhook.Mention{Mentionees: []webhook.MentioneeInterface{
+			webhook.UserMentionee{Index: index, Length: length, IsSelf: self},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		message webhook.TextMessageContent
+		want    string
+		ok      bool
+	}{
+		{"slash command", webhook.TextMessageContent{Text: " /stats 7d"}, "/stats 7d", true},
+		{"plain text", webhook.TextMessageContent{Text: "stats please"}, "", false},
+		{"mention without slash", webhook.TextMessageContent{Text: "@Photo Bot stats 7d", Mention: mention(0, 10, true)}, "/stats 7d", true},
+		{"mention with slash", webhook.TextMessageContent{Text: "@Photo Bot /help", Mention: mention(0, 10, true)}, "/help", true},
+		{"bare mention", webhook.TextMessageContent{Text: "@Photo Bot", Mention: mention(0, 10, true)}, "/help", true},
+		// 📸 is two UTF-16 code units, so the mention starts at 10
+		{"mention after emoji", webhook.TextMessageContent{Text: "/stats 📸 @Bot", Mention: mention(10, 4, true)}, "/stats 📸", true},
+		{"mention later in text", webhook.TextMessageContent{Text: "thanks @Bot", Mention: mention(7, 4, true)}, "", false},
+		{"someone else mentioned", webhook.TextMessageContent{Text: "@Alice stats", Mention: mention(0, 6, false)}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := commandText(tt.message)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("commandText() = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDailyUploadsAreSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), groupCacheFile)
+	groupCache := NewGroupCache()
+	groupCache.AddUploadedFile("group-1", "a.jpg", "")
+	groupCache.AddUploadedFile("group-2", "b.jpg", "")
+	if err := groupCache.Save(path); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+
+	loaded := NewGroupCache()
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	yesterday := time.Now().AddDate(0, 0, -1)
+	if got := loaded.UploadsSince("group-1", yesterday); got != 1 {
+		t.Errorf("UploadsSince() = %d, want 1", got)
+	}
+	if got := loaded.GlobalUploadsSince(yesterday); got != 2 {
+		t.Errorf("GlobalUploadsSince() = %d, want 2", got)
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want time.Duration
+		ok   bool
+	}{
+		{"7d", 7 * 24 * time.Hour, true},
+		{"2W", 14 * 24 * time.Hour, true},
+		{"366d", 366 * 24 * time.Hour, true},
+		// Only days are counted
+		{"24h", 0, false},
+		{"367d", 0, false},
+		{"53w", 0, false},
+		{"9223372036854775807d", 0, false},
+		{"0d", 0, false},
+		{"d", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePeriod(tt.arg)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("parsePeriod(%q) = %v, %v, want %v", tt.arg, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	contactSheetsDir      = "contact-sheets" // inside Config.StateDir
+	contactSheetDayLayout = "2006-01-02"
+	contactSheetInterval  = time.Hour
+
+	contactSheetColumns = 6
+	contactSheetRows    = 8
+	contactSheetCell    = 200
+	contactSheetGap     = 8
+)
+
+// ContactSheets collects the thumbnails of each chat on disk, grouped by day,
+// until the day is over and they are rendered into contact sheets. Keeping
+// them on disk lets a day survive restarts.
+//
+// Layout: <dir>/<chat folder ID>/<YYYY-MM-DD>/<sequence>-<message ID>.jpg
+type ContactSheets struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewContactSheets(dir string) *ContactSheets {
+	return &ContactSheets{dir: dir}
+}
+
+// contactSheetDay identifies the thumbnails of one chat for one day
+type contactSheetDay struct {
+	FolderID string
+	Day      time.Time
+}
+
+// Add stores the JPEG thumbnail of messageID for the chat whose root folder
+// is folderID
+func (c *ContactSheets) Add(folderID, messageID string, day time.Time, thumbnail []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := filepath.Join(c.dir, folderID, day.Format(contactSheetDayLayout))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%s.jpg", time.Now().UnixNano(), messageID)
+	return os.WriteFile(filepath.Join(dir, name), thumbnail, 0o600)
+}
+
+// RemoveMessage drops the thumbnail of messageID from the days still waiting
+// for their contact sheets, so an unsent photo does not show up on one
+func (c *ContactSheets) RemoveMessage(messageID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*", "*", "*-"+messageID+".jpg"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending returns the chat days that ended before now and still wait for
+// their contact sheets.
+func (c *ContactSheets) Pending(now time.Time) ([]contactSheetDay, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	folders, err := os.ReadDir(c.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	today := now.Format(contactSheetDayLayout)
+	var days []contactSheetDay
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(c.dir, folder.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			// The layout sorts chronologically as text
+			if !entry.IsDir() || entry.Name() >= today {
+				continue
+			}
+			day, err := time.ParseInLocation(contactSheetDayLayout, entry.Name(), now.Location())
+			if err != nil {
+				continue
+			}
+			days = append(days, contactSheetDay{FolderID: folder.Name(), Day: day})
+		}
+	}
+	return days, nil
+}
+
+// Render draws the thumbnails of a chat day into JPEG contact sheets. Days
+// with more thumbnails than fit on one sheet get several pages.
+func (c *ContactSheets) Render(day contactSheetDay) ([][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := c.dayDir(day)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	perSheet := contactSheetColumns * contactSheetRows
+	var sheets [][]byte
+	for start := 0; start < len(names); start += perSheet {
+		var tiles []image.Image
+		for _, name := range names[start:min(start+perSheet, len(names))] {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			tile, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				log.Printf("Skipping unreadable thumbnail %s: %v", name, err)
+				continue
+			}
+			tiles = append(tiles, tile)
+		}
+		if len(tiles) == 0 {
+			continue
+		}
+
+		sheet, err := encodeJPEG(renderContactSheet(tiles))
+		if err != nil {
+			return nil, err
+		}
+		sheets = append(sheets, sheet)
+	}
+	return sheets, nil
+}
+
+// Remove deletes the thumbnails of a chat day once its sheets are uploaded
+func (c *ContactSheets) Remove(day contactSheetDay) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.RemoveAll(c.dayDir(day)); err != nil {
+		return err
+	}
+	// Drop the chat directory once it is empty; a failure just means it is not
+	os.Remove(filepath.Join(c.dir, day.FolderID))
+	return nil
+}
+
+func (c *ContactSheets) dayDir(day contactSheetDay) string {
+	return filepath.Join(c.dir, day.FolderID, day.Day.Format(contactSheetDayLayout))
+}
+
+// renderContactSheet lays the tiles out in a grid on a white background,
+// each one centered in its cell.
+func renderContactSheet(tiles []image.Image) *image.RGBA {
+	columns := min(len(tiles), contactSheetColumns)
+	rows := (len(tiles) + contactSheetColumns - 1) / contactSheetColumns
+	width := columns*(contactSheetCell+contactSheetGap) + contactSheetGap
+	height := rows*(contactSheetCell+contactSheetGap) + contactSheetGap
+
+	sheet := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	for i, tile := range tiles {
+		scaled := resizeToFit(tile, contactSheetCell)
+		size := scaled.Bounds().Size()
+		cellX := contactSheetGap + (i%contactSheetColumns)*(contactSheetCell+contactSheetGap)
+		cellY := contactSheetGap + (i/contactSheetColumns)*(contactSheetCell+contactSheetGap)
+		at := image.Pt(cellX+(contactSheetCell-size.X)/2, cellY+(contactSheetCell-size.Y)/2)
+		draw.Draw(sheet, image.Rectangle{Min: at, Max: at.Add(size)}, scaled, image.Point{}, draw.Src)
+	}
+	return sheet
+}
+
+// contactSheetName names the sheet for a day; later pages get a suffix
+func contactSheetName(day time.Time, page int) string {
+	name := "contact-sheet-" + day.Format(contactSheetDayLayout)
+	if page > 1 {
+		name += fmt.Sprintf("-%d", page)
+	}
+	return name + ".jpg"
+}
+
+// publishContactSheets uploads the contact sheets of every chat day that
+// ended before now into the chat's Thumbnails folder. A day that fails is
+// kept for the next run without holding up the others.
+func (p *Pipeline) publishContactSheets(now time.Time) error {
+	days, err := p.contactSheets.Pending(now)
+	if err != nil {
+		return fmt.Errorf("failed to list contact sheets: %v", err)
+	}
+
+	failed := 0
+	for _, day := range days {
+		if err := p.publishContactSheetDay(day); err != nil {
+			log.Printf("Error publishing contact sheet of %s for %s: %v",
+				day.FolderID, day.Day.Format(contactSheetDayLayout), err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to publish %d of %d contact sheet days", failed, len(days))
+	}
+	return nil
+}
+
+// publishContactSheetDay uploads the pages of one chat day. Pages replace
+// those of the same name, so retrying a day does not duplicate the pages
+// that already made it.
+func (p *Pipeline) publishContactSheetDay(day contactSheetDay) error {
+	sheets, err := p.contactSheets.Render(day)
+	if err != nil {
+		return fmt.Errorf("failed to render contact sheet: %v", err)
+	}
+	// Every photo of the day may have been unsent
+	if len(sheets) > 0 {
+		folderID, err := p.folder(thumbnailFolderName, day.FolderID)
+		if err != nil {
+			return err
+		}
+		for i, sheet := range sheets {
+			name := contactSheetName(day.Day, i+1)
+			if err := p.replaceFile(folderID, name, "image/jpeg", bytes.NewReader(sheet)); err != nil {
+				return err
+			}
+			log.Printf("Contact sheet uploaded: %s", name)
+		}
+	}
+
+	if err := p.contactSheets.Remove(day); err != nil {
+		return fmt.Errorf("failed to clean up contact sheet thumbnails: %v", err)
+	}
+	return nil
+}
+
+// runContactSheets publishes finished days on start and then every
+// contactSheetInterval until ctx is done.
+func (p *Pipeline) runContactSheets(ctx context.Context) {
+	ticker := time.NewTicker(contactSheetInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.publishContactSheets(time.Now()); err != nil {
+			log.Printf("Error publishing contact sheets: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func testThumbnail(t *testing.T) []byte {
+	t.Helper()
+	data, err := encodeJPEG(image.NewRGBA(image.Rect(0, 0, 40, 30)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestContactSheetsPending(t *testing.T) {
+	sheets := NewContactSheets(t.TempDir())
+	now := time.Date(2024, 5, 17, 12, 0, 0, 0, time.Local)
+
+	if err := sheets.Add("folder-a", "", now.AddDate(0, 0, -1), testThumbnail(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sheets.Add("folder-a", "", now, testThumbnail(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	days, err := sheets.Pending(now)
+	if err != nil {
+		t.Fatalf("Pending() error: %v", err)
+	}
+	if len(days) != 1 {
+		t.Fatalf("Pending() returned %d days, want only yesterday", len(days))
+	}
+	if days[0].FolderID != "folder-a" || days[0].Day.Format(contactSheetDayLayout) != "2024-05-16" {
+		t.Errorf("Pending() = %+v, want folder-a on 2024-05-16", days[0])
+	}
+}
+
+func TestContactSheetsRenderPages(t *testing.T) {
+	sheets := NewContactSheets(t.TempDir())
+	day := time.Date(2024, 5, 16, 0, 0, 0, 0, time.Local)
+
+	perSheet := contactSheetColumns * contactSheetRows
+	for i := 0; i < perSheet+1; i++ {
+		if err := sheets.Add("folder-a", "", day, testThumbnail(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pages, err := sheets.Render(contactSheetDay{FolderID: "folder-a", Day: day})
+	if err != nil {
+		t.Fatalf("Render() error: %v", err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("Render() returned %d pages, want 2", len(pages))
+	}
+
+	first, err := jpeg.Decode(bytes.NewReader(pages[0]))
+	if err != nil {
+		t.Fatalf("page is not a JPEG: %v", err)
+	}
+	wantWidth := contactSheetColumns*(contactSheetCell+contactSheetGap) + contactSheetGap
+	wantHeight := contactSheetRows*(contactSheetCell+contactSheetGap) + contactSheetGap
+	if size := first.Bounds().Size(); size != image.Pt(wantWidth, wantHeight) {
+		t.Errorf("first page size = %v, want (%d,%d)", size, wantWidth, wantHeight)
+	}
+}
+
+func TestPublishContactSheets(t *testing.T) {
+	dir := t.TempDir()
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{}, driveService, newTestConfig())
+	pipeline.contactSheets = NewContactSheets(dir)
+
+	day := time.Date(2024, 5, 16, 0, 0, 0, 0, time.Local)
+	if err := pipeline.contactSheets.Add("group-folder", "msg-1", day, testThumbnail(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pipeline.publishContactSheets(day.AddDate(0, 0, 1)); err != nil {
+		t.Fatalf("publishContactSheets() error: %v", err)
+	}
+
+	created := driveService.files.created
+	last := created[len(created)-1]
+	if last.Name != "contact-sheet-2024-05-16.jpg" {
+		t.Errorf("uploaded %q, want contact-sheet-2024-05-16.jpg", last.Name)
+	}
+	if created[0].Name != thumbnailFolderName || created[0].Parents[0] != "group-folder" {
+		t.Errorf("sheet folder = %q in %v, want Thumbnails in group-folder", created[0].Name, created[0].Parents)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "group-folder")); !os.IsNotExist(err) {
+		t.Errorf("thumbnails were not cleaned up after publishing: %v", err)
+	}
+}
+
+// failingFilesService fails the first upload of a file called failName
+type failingFilesService struct {
+	*mockFilesService
+	failName string
+}
+
+func (f *failingFilesService) CreateFile(file *drive.File, media io.Reader) (*drive.File, error) {
+	if file.Name == f.failName {
+		f.failName = ""
+		return nil, errors.New("upload failed")
+	}
+	return f.mockFilesService.CreateFile(file, media)
+}
+
+type failingDriveService struct {
+	files *failingFilesService
+}
+
+func (d *failingDriveService) Files() FilesService {
+	return d.files
+}
+
+func TestPublishContactSheetsRetriesFailedDays(t *testing.T) {
+	files := &failingFilesService{mockFilesService: &mockFilesService{}, failName: "contact-sheet-2024-05-16-2.jpg"}
+	pipeline := newTestPipeline(&mockBlobAPI{}, &failingDriveService{files: files}, newTestConfig())
+	pipeline.contactSheets = NewContactSheets(t.TempDir())
+
+	day := time.Date(2024, 5, 16, 0, 0, 0, 0, time.Local)
+	for i := 0; i < contactSheetColumns*contactSheetRows+1; i++ {
+		if err := pipeline.contactSheets.Add("folder-a", "", day, testThumbnail(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pipeline.contactSheets.Add("folder-b", "", day, testThumbnail(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second page of folder-a fails; folder-b is published anyway
+	if err := pipeline.publishContactSheets(day.AddDate(0, 0, 1)); err == nil {
+		t.Fatal("publishContactSheets() succeeded with a failed upload")
+	}
+	if days, _ := pipeline.contactSheets.Pending(day.AddDate(0, 0, 1)); len(days) != 1 || days[0].FolderID != "folder-a" {
+		t.Fatalf("pending %+v, want only folder-a", days)
+	}
+
+	// The retry replaces the first page instead of uploading it again
+	files.existing = files.created
+	if err := pipeline.publishContactSheets(day.AddDate(0, 0, 1)); err != nil {
+		t.Fatalf("publishContactSheets() error: %v", err)
+	}
+	counts := map[string]int{}
+	for _, f := range files.created {
+		counts[f.Name]++
+	}
+	if counts["contact-sheet-2024-05-16.jpg"] != 2 || counts["contact-sheet-2024-05-16-2.jpg"] != 1 {
+		t.Errorf("created %v, want the first page once per chat and the second page once", counts)
+	}
+	if len(files.updated) != 1 {
+		t.Errorf("updated %v, want the first page of folder-a replaced", files.updated)
+	}
+}
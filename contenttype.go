@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// sniffLen is how much of the content is inspected for magic bytes
+const sniffLen = 512
+
+// Extensions for the MIME types we expect to see from LINE
+var mimeExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/heic":      ".heic",
+	"image/heif":      ".heif",
+	"image/avif":      ".avif",
+	"image/bmp":       ".bmp",
+	"image/tiff":      ".tiff",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"video/3gpp":      ".3gp",
+	"video/webm":      ".webm",
+	"audio/mp4":       ".m4a",
+	"audio/aac":       ".aac",
+	"audio/mpeg":      ".mp3",
+	"audio/wave":      ".wav",
+	"audio/ogg":       ".ogg",
+	"application/ogg": ".ogg",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+}
+
+// ISO base media file brands (the "ftyp" box) and the type they denote
+var ftypBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"avif": "image/avif",
+	"qt  ": "video/quicktime",
+	"M4A ": "audio/mp4",
+	"M4B ": "audio/mp4",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3gp6": "video/3gpp",
+	"3g2a": "video/3gpp",
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"avc1": "video/mp4",
+	"dash": "video/mp4",
+	"M4V ": "video/mp4",
+}
+
+// detectContentType identifies content from its leading bytes, falling back
+// to the Content-Type declared by the server when the bytes are not
+// conclusive. It returns "application/octet-stream" when nothing matches.
+func detectContentType(header []byte, declared string) string {
+	if mimeType := sniffISOBMFF(header); mimeType != "" {
+		return mimeType
+	}
+
+	sniffed := normalizeMimeType(http.DetectContentType(header))
+	if sniffed != "application/octet-stream" && !strings.HasPrefix(sniffed, "text/") {
+		return sniffed
+	}
+
+	if declared = normalizeMimeType(declared); declared != "" && declared != "application/octet-stream" {
+		return declared
+	}
+	return sniffed
+}
+
+// sniffISOBMFF recognizes MP4/MOV/HEIC style containers by their ftyp brand.
+// http.DetectContentType only knows a few of these and reports everything
+// else as octet-stream.
+func sniffISOBMFF(header []byte) string {
+	if len(header) < 12 || !bytes.Equal(header[4:8], []byte("ftyp")) {
+		return ""
+	}
+
+	if mimeType, ok := ftypBrands[string(header[8:12])]; ok {
+		return mimeType
+	}
+
+	// Fall back to the compatible brands listed after the minor version
+	boxSize := int(binary.BigEndian.Uint32(header[:4]))
+	if boxSize > len(header) {
+		boxSize = len(header)
+	}
+	for i := 16; i+4 <= boxSize; i += 4 {
+		if mimeType, ok := ftypBrands[string(header[i:i+4])]; ok {
+			return mimeType
+		}
+	}
+	return ""
+}
+
+func normalizeMimeType(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(mimeType))
+	}
+	return mediaType
+}
+
+// extensionForMimeType returns the preferred file extension for a MIME type
+func extensionForMimeType(mimeType string) string {
+	if ext, ok := mimeExtensions[mimeType]; ok {
+		return ext
+	}
+	if mimeType == "application/octet-stream" {
+		return ""
+	}
+	if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// detectMessageContentType resolves the MIME type and extension for a
+// message's content. Audio messages are MP4 containers without video, so a
+// generic MP4 result is reported as M4A for them. File messages fall back to
+// the type implied by their original name.
+func detectMessageContentType(message webhook.MessageContentInterface, header []byte, declared string) (string, string) {
+	mimeType := detectContentType(header, declared)
+
+	switch m := message.(type) {
+	case webhook.AudioMessageContent:
+		if mimeType == "video/mp4" {
+			mimeType = "audio/mp4"
+		}
+	case webhook.FileMessageContent:
+		if mimeType == "application/octet-stream" {
+			if byExt := mime.TypeByExtension(filepath.Ext(m.FileName)); byExt != "" {
+				mimeType = normalizeMimeType(byExt)
+			}
+		}
+	}
+
+	ext := extensionForMimeType(mimeType)
+	if ext == "" {
+		ext = getFileExtension(message)
+	}
+	return mimeType, ext
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// ftypHeader builds a minimal ISO BMFF header with the given brands
+func ftypHeader(major string, compatible ...string) []byte {
+	box := []byte{0, 0, 0, byte(16 + 4*len(compatible))}
+	box = append(box, "ftyp"+major+"\x00\x00\x00\x00"...)
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	return append(box, "\x00\x00\x00\x08free"...)
+}
+
+func TestDetectMessageContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  webhook.MessageContentInterface
+		header   []byte
+		declared string
+		wantMime string
+		wantExt  string
+	}{
+		{
+			name:     "JPEG image",
+			message:  webhook.ImageMessageContent{},
+			header:   []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"),
+			wantMime: "image/jpeg",
+			wantExt:  ".jpg",
+		},
+		{
+			name:     "PNG image",
+			message:  webhook.ImageMessageContent{},
+			header:   []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"),
+			wantMime: "image/png",
+			wantExt:  ".png",
+		},
+		{
+			name:     "GIF image",
+			message:  webhook.ImageMessageContent{},
+			header:   []byte("GIF89a\x01\x00\x01\x00"),
+			wantMime: "image/gif",
+			wantExt:  ".gif",
+		},
+		{
+			name:     "HEIC image",
+			message:  webhook.ImageMessageContent{},
+			header:   ftypHeader("heic", "mif1", "heic"),
+			wantMime: "image/heic",
+			wantExt:  ".heic",
+		},
+		{
+			name:     "HEIF by compatible brand",
+			message:  webhook.ImageMessageContent{},
+			header:   ftypHeader("xxxx", "mif1"),
+			wantMime: "image/heif",
+			wantExt:  ".heif",
+		},
+		{
+			name:     "QuickTime video",
+			message:  webhook.VideoMessageContent{},
+			header:   ftypHeader("qt  "),
+			wantMime: "video/quicktime",
+			wantExt:  ".mov",
+		},
+		{
+			name:     "MP4 video",
+			message:  webhook.VideoMessageContent{},
+			header:   ftypHeader("isom", "isom", "mp41"),
+			wantMime: "video/mp4",
+			wantExt:  ".mp4",
+		},
+		{
+			name:     "Audio in MP4 container",
+			message:  webhook.AudioMessageContent{},
+			header:   ftypHeader("mp42"),
+			wantMime: "audio/mp4",
+			wantExt:  ".m4a",
+		},
+		{
+			name:     "Unknown bytes use declared type",
+			message:  webhook.ImageMessageContent{},
+			header:   []byte{0x00, 0x01, 0x02, 0x03},
+			declared: "image/png; charset=binary",
+			wantMime: "image/png",
+			wantExt:  ".png",
+		},
+		{
+			name:     "Unknown file uses its extension",
+			message:  webhook.FileMessageContent{FileName: "notes.pdf"},
+			header:   []byte{0x00, 0x01, 0x02, 0x03},
+			wantMime: "application/pdf",
+			wantExt:  ".pdf",
+		},
+		{
+			name:     "Unknown image keeps default extension",
+			message:  webhook.ImageMessageContent{},
+			header:   []byte{0x00, 0x01, 0x02, 0x03},
+			wantMime: "application/octet-stream",
+			wantExt:  ".jpg",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotMime, gotExt := detectMessageContentType(tt.message, tt.header, tt.declared)
+			if gotMime != tt.wantMime || gotExt != tt.wantExt {
+				t.Errorf("detectMessageContentType() = %s, %s; want %s, %s",
+					gotMime, gotExt, tt.wantMime, tt.wantExt)
+			}
+		})
+	}
+}
+
+func TestHandleFileSetsDetectedType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	driveService := newMockDriveService()
+	config := &Config{GoogleDriveFolderID: "mock-folder"}
+	pipeline := newTestPipeline(&mockBlobAPI{content: png}, driveService, config)
+
+	message := webhook.ImageMessageContent{Id: "img-1"}
+	if _, err := pipeline.handleFile(context.Background(), message, "img-1", ".jpg", "", config.GoogleDriveFolderID, GroupSettings{}, chatNames{}); err != nil {
+		t.Fatalf("handleFile() error: %v", err)
+	}
+
+	created := driveService.files.created[0]
+	if !strings.HasSuffix(created.Name, ".png") {
+		t.Errorf("File name = %s, want .png extension", created.Name)
+	}
+	if created.MimeType != "image/png" {
+		t.Errorf("MimeType = %s, want image/png", created.MimeType)
+	}
+}
+
+func TestStatsRecordStoredName(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	pipeline := newTestPipeline(&mockBlobAPI{content: png}, newMockDriveService(), newTestConfig())
+
+	job := UploadJob{MessageID: "img-1", Type: "image", GroupID: "group-1"}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+	_, _, recent := pipeline.groupCache.GetStats("group-1")
+	if len(recent) != 1 || !strings.HasSuffix(recent[0].Name, ".png") || recent[0].Name == "file.png" {
+		t.Errorf("RecentFiles = %+v, want the stored PNG name", recent)
+	}
+}
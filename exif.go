@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// metadataPeekLen is how much of the content is buffered up front to find
+// the capture date. EXIF sits at the start of photos; MP4 metadata is only
+// found when the "moov" box precedes the media data (fast-start files).
+const metadataPeekLen = 256 * 1024
+
+// EXIF tags used to find the capture date
+const (
+	tagDateTime           = 0x0132
+	tagExifIFDPointer     = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagDateTimeDigitized  = 0x9004
+	tagOffsetTimeOriginal = 0x9011
+	exifTypeASCII         = 2
+)
+
+// extractCaptureTime returns when a photo or video was taken, based on the
+// metadata found in its leading bytes.
+func extractCaptureTime(header []byte, mimeType string) (time.Time, bool) {
+	var tiff []byte
+	switch {
+	case mimeType == "image/jpeg":
+		tiff = jpegExifData(header)
+	case mimeType == "image/png":
+		tiff = pngExifData(header)
+	case strings.HasPrefix(mimeType, "video/") || mimeType == "audio/mp4":
+		return mp4CreationTime(header)
+	}
+
+	// HEIC, WebP and friends embed the same TIFF block; look for its marker
+	if tiff == nil && strings.HasPrefix(mimeType, "image/") {
+		if i := bytes.Index(header, []byte("Exif\x00\x00")); i >= 0 {
+			tiff = header[i+6:]
+		}
+	}
+	if tiff == nil {
+		return time.Time{}, false
+	}
+	return exifCaptureTime(tiff)
+}
+
+// jpegExifData returns the TIFF block of the APP1 Exif segment
+func jpegExifData(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		// Start of scan: image data follows, no more metadata
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + size
+		if size < 2 || end > len(data) {
+			return nil
+		}
+		segment := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i = end
+	}
+	return nil
+}
+
+// pngExifData returns the content of the eXIf chunk
+func pngExifData(data []byte) []byte {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return nil
+	}
+
+	for i := 8; i+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[i : i+4]))
+		chunkType := string(data[i+4 : i+8])
+		end := i + 8 + size
+		if end+4 > len(data) {
+			return nil
+		}
+		switch chunkType {
+		case "eXIf":
+			return data[i+8 : end]
+		case "IDAT", "IEND":
+			return nil
+		}
+		i = end + 4 // skip CRC
+	}
+	return nil
+}
+
+// tiffReader reads IFD entries from an EXIF TIFF block
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// newTIFFReader checks the TIFF header and picks the byte order
+func newTIFFReader(data []byte) (*tiffReader, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	switch string(data[:4]) {
+	case "II*\x00":
+		return &tiffReader{data: data, order: binary.LittleEndian}, true
+	case "MM\x00*":
+		return &tiffReader{data: data, order: binary.BigEndian}, true
+	}
+	return nil, false
+}
+
+func (r *tiffReader) uint16At(off int) (uint16, bool) {
+	if off < 0 || off+2 > len(r.data) {
+		return 0, false
+	}
+	return r.order.Uint16(r.data[off:]), true
+}
+
+func (r *tiffReader) uint32At(off int) (uint32, bool) {
+	if off < 0 || off+4 > len(r.data) {
+		return 0, false
+	}
+	return r.order.Uint32(r.data[off:]), true
+}
+
+// readIFD returns the entries of the IFD at off, keyed by tag
+func (r *tiffReader) readIFD(off int) map[uint16]ifdEntry {
+	count, ok := r.uint16At(off)
+	if !ok {
+		return nil
+	}
+
+	entries := make(map[uint16]ifdEntry, count)
+	for n := 0; n < int(count); n++ {
+		base := off + 2 + n*12
+		tag, ok1 := r.uint16At(base)
+		typ, ok2 := r.uint16At(base + 2)
+		cnt, ok3 := r.uint32At(base + 4)
+		if !ok1 || !ok2 || !ok3 {
+			break
+		}
+		entries[tag] = ifdEntry{typ: typ, count: cnt, valueOffset: base + 8}
+	}
+	return entries
+}
+
+type ifdEntry struct {
+	typ         uint16
+	count       uint32
+	valueOffset int // offset of the value field within the entry
+}
+
+// ascii returns the string value of an ASCII entry
+func (r *tiffReader) ascii(e ifdEntry) string {
+	if e.typ != exifTypeASCII || e.count == 0 {
+		return ""
+	}
+
+	start := e.valueOffset
+	// Values longer than 4 bytes live elsewhere, the field holds an offset
+	if e.count > 4 {
+		off, ok := r.uint32At(e.valueOffset)
+		if !ok {
+			return ""
+		}
+		start = int(off)
+	}
+	end := start + int(e.count)
+	if start < 0 || end > len(r.data) {
+		return ""
+	}
+	return strings.TrimRight(string(r.data[start:end]), "\x00 ")
+}
+
+// exifCaptureTime reads DateTimeOriginal (falling back to DateTimeDigitized
+// and DateTime) from a TIFF block. Without an OffsetTimeOriginal the time is
+// interpreted in the server's local zone.
+func exifCaptureTime(data []byte) (time.Time, bool) {
+	r, ok := newTIFFReader(data)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	ifd0Offset, _ := r.uint32At(4)
+	ifd0 := r.readIFD(int(ifd0Offset))
+
+	var original, digitized, offset string
+	if ptr, ok := ifd0[tagExifIFDPointer]; ok {
+		if exifOffset, ok := r.uint32At(ptr.valueOffset); ok {
+			exifIFD := r.readIFD(int(exifOffset))
+			original = r.ascii(exifIFD[tagDateTimeOriginal])
+			digitized = r.ascii(exifIFD[tagDateTimeDigitized])
+			offset = r.ascii(exifIFD[tagOffsetTimeOriginal])
+		}
+	}
+
+	for _, value := range []string{original, digitized, r.ascii(ifd0[tagDateTime])} {
+		if t, ok := parseExifTime(value, offset); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func parseExifTime(value, offset string) (time.Time, bool) {
+	// Cameras without a clock write blanks or zeros
+	if value == "" || strings.HasPrefix(value, "0000") {
+		return time.Time{}, false
+	}
+
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// mp4Epoch is the reference time of MP4/QuickTime timestamps
+var mp4Epoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// mp4CreationTime reads the creation time from the movie header (moov/mvhd)
+func mp4CreationTime(data []byte) (time.Time, bool) {
+	moov := findMP4Box(data, "moov")
+	if moov == nil {
+		return time.Time{}, false
+	}
+	mvhd := findMP4Box(moov, "mvhd")
+	if len(mvhd) < 4 {
+		return time.Time{}, false
+	}
+
+	var seconds uint64
+	switch mvhd[0] {
+	case 0:
+		if len(mvhd) < 8 {
+			return time.Time{}, false
+		}
+		seconds = uint64(binary.BigEndian.Uint32(mvhd[4:8]))
+	case 1:
+		if len(mvhd) < 12 {
+			return time.Time{}, false
+		}
+		seconds = binary.BigEndian.Uint64(mvhd[4:12])
+	default:
+		return time.Time{}, false
+	}
+
+	// Many encoders leave the field unset
+	if seconds == 0 {
+		return time.Time{}, false
+	}
+	return mp4Epoch.Add(time.Duration(seconds) * time.Second), true
+}
+
+// findMP4Box returns the payload of the first box of the given type among
+// the boxes in data.
+func findMP4Box(data []byte, boxType string) []byte {
+	for i := 0; i+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[i : i+4]))
+		headerLen := uint64(8)
+		switch size {
+		case 0: // box extends to the end of the file
+			size = uint64(len(data) - i)
+		case 1: // 64-bit size follows the type
+			if i+16 > len(data) {
+				return nil
+			}
+			size = binary.BigEndian.Uint64(data[i+8 : i+16])
+			headerLen = 16
+		}
+		if size < headerLen {
+			return nil
+		}
+
+		start := i + int(headerLen)
+		truncated := size > uint64(len(data)-i)
+		if string(data[i+4:i+8]) == boxType {
+			if truncated {
+				// Cut off by the peek window; return what we have
+				return data[start:]
+			}
+			return data[start : i+int(size)]
+		}
+		if truncated {
+			return nil
+		}
+		i += int(size)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+	"google.golang.org/api/drive/v3"
+)
+
+// buildTIFF returns a little-endian TIFF block whose Exif IFD holds the
+// given DateTimeOriginal and OffsetTimeOriginal (either may be empty).
+func buildTIFF(original, offset string) []byte {
+	type entry struct {
+		tag   uint16
+		value string
+	}
+	var exifEntries []entry
+	if original != "" {
+		exifEntries = append(exifEntries, entry{tagDateTimeOriginal, original})
+	}
+	if offset != "" {
+		exifEntries = append(exifEntries, entry{tagOffsetTimeOriginal, offset})
+	}
+
+	le := binary.LittleEndian
+	ifd0Offset := 8
+	exifOffset := ifd0Offset + 2 + 12 + 4
+	dataOffset := exifOffset + 2 + 12*len(exifEntries) + 4
+
+	buf := make([]byte, dataOffset)
+	copy(buf, "II*\x00")
+	le.PutUint32(buf[4:], uint32(ifd0Offset))
+
+	// IFD0 with only the Exif IFD pointer
+	le.PutUint16(buf[ifd0Offset:], 1)
+	le.PutUint16(buf[ifd0Offset+2:], tagExifIFDPointer)
+	le.PutUint16(buf[ifd0Offset+4:], 4) // LONG
+	le.PutUint32(buf[ifd0Offset+6:], 1)
+	le.PutUint32(buf[ifd0Offset+10:], uint32(exifOffset))
+
+	le.PutUint16(buf[exifOffset:], uint16(len(exifEntries)))
+	for i, e := range exifEntries {
+		base := exifOffset + 2 + i*12
+		value := append([]byte(e.value), 0)
+		le.PutUint16(buf[base:], e.tag)
+		le.PutUint16(buf[base+2:], exifTypeASCII)
+		le.PutUint32(buf[base+4:], uint32(len(value)))
+		le.PutUint32(buf[base+8:], uint32(len(buf)))
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+func buildJPEG(tiff []byte) []byte {
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	jpeg := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(jpeg[4:], uint16(len(payload)+2))
+	jpeg = append(jpeg, payload...)
+	return append(jpeg, 0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9)
+}
+
+func buildPNG(tiff []byte) []byte {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	chunk := make([]byte, 8)
+	binary.BigEndian.PutUint32(chunk, uint32(len(tiff)))
+	copy(chunk[4:], "eXIf")
+	png = append(png, chunk...)
+	png = append(png, tiff...)
+	return append(png, 0, 0, 0, 0) // CRC is not checked
+}
+
+func buildMP4(created time.Time) []byte {
+	mvhd := make([]byte, 8+100)
+	binary.BigEndian.PutUint32(mvhd, uint32(len(mvhd)))
+	copy(mvhd[4:], "mvhd")
+	binary.BigEndian.PutUint32(mvhd[12:], uint32(created.Sub(mp4Epoch)/time.Second))
+
+	moov := make([]byte, 8)
+	binary.BigEndian.PutUint32(moov, uint32(8+len(mvhd)))
+	copy(moov[4:], "moov")
+	moov = append(moov, mvhd...)
+
+	return append(ftypHeader("isom", "isom"), moov...)
+}
+
+func TestExtractCaptureTime(t *testing.T) {
+	taken := time.Date(2024, 5, 17, 14, 30, 5, 0, time.FixedZone("", 9*3600))
+
+	tests := []struct {
+		name     string
+		data     []byte
+		mimeType string
+		want     time.Time
+		wantOK   bool
+	}{
+		{
+			name:     "JPEG with offset",
+			data:     buildJPEG(buildTIFF("2024:05:17 14:30:05", "+09:00")),
+			mimeType: "image/jpeg",
+			want:     taken,
+			wantOK:   true,
+		},
+		{
+			name:     "JPEG without offset uses local time",
+			data:     buildJPEG(buildTIFF("2024:05:17 14:30:05", "")),
+			mimeType: "image/jpeg",
+			want:     time.Date(2024, 5, 17, 14, 30, 5, 0, time.Local),
+			wantOK:   true,
+		},
+		{
+			name:     "PNG eXIf chunk",
+			data:     buildPNG(buildTIFF("2024:05:17 14:30:05", "+09:00")),
+			mimeType: "image/png",
+			want:     taken,
+			wantOK:   true,
+		},
+		{
+			name:     "HEIC with embedded Exif block",
+			data:     append(append(ftypHeader("heic"), "\x00\x00\x00\x06Exif\x00\x00"...), buildTIFF("2024:05:17 14:30:05", "+09:00")...),
+			mimeType: "image/heic",
+			want:     taken,
+			wantOK:   true,
+		},
+		{
+			name:     "MP4 movie header",
+			data:     buildMP4(taken),
+			mimeType: "video/mp4",
+			want:     taken,
+			wantOK:   true,
+		},
+		{
+			name:     "Zeroed date",
+			data:     buildJPEG(buildTIFF("0000:00:00 00:00:00", "")),
+			mimeType: "image/jpeg",
+		},
+		{
+			name:     "JPEG without EXIF",
+			data:     []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02},
+			mimeType: "image/jpeg",
+		},
+		{
+			name:     "Truncated MP4",
+			data:     buildMP4(taken)[:30],
+			mimeType: "video/mp4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := extractCaptureTime(tt.data, tt.mimeType)
+			if ok != tt.wantOK {
+				t.Fatalf("extractCaptureTime() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && !got.Equal(tt.want) {
+				t.Errorf("extractCaptureTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleFileUsesCaptureDate(t *testing.T) {
+	photo := buildJPEG(buildTIFF("2023:12:24 18:00:00", "+00:00"))
+	driveService := newMockDriveService()
+	config := &Config{GoogleDriveFolderID: "root-folder", DateFolderFormat: "2006/01"}
+	pipeline := newTestPipeline(&mockBlobAPI{content: photo}, driveService, config)
+
+	message := webhook.ImageMessageContent{Id: "img-1"}
+	if _, err := pipeline.handleFile(context.Background(), message, "img-1", ".jpg", "", "root-folder", GroupSettings{}, chatNames{}); err != nil {
+		t.Fatalf("handleFile() error: %v", err)
+	}
+
+	// Two date folders followed by the photo itself
+	created := driveService.files.created
+	if len(created) != 3 {
+		t.Fatalf("Created %d files, want 3", len(created))
+	}
+	if created[0].Name != "2023" || created[0].Parents[0] != "root-folder" || created[1].Name != "12" {
+		t.Errorf("Date folders = %s/%s, want 2023/12", created[0].Name, created[1].Name)
+	}
+
+	photoFile := created[2]
+	if !strings.HasPrefix(photoFile.Name, "line-file-20231224-180000-img-1") {
+		t.Errorf("File name = %s, want capture date prefix", photoFile.Name)
+	}
+	if photoFile.AppProperties["captureTime"] != "2023-12-24T18:00:00Z" {
+		t.Errorf("captureTime property = %q", photoFile.AppProperties["captureTime"])
+	}
+	if photoFile.CreatedTime != "2023-12-24T18:00:00Z" {
+		t.Errorf("CreatedTime = %q", photoFile.CreatedTime)
+	}
+
+	// The folders are cached for the next upload
+	driveService.files.created = nil
+	if _, err := pipeline.handleFile(context.Background(), message, "img-1", ".jpg", "", "root-folder", GroupSettings{}, chatNames{}); err != nil {
+		t.Fatalf("handleFile() error: %v", err)
+	}
+	if len(driveService.files.created) != 1 {
+		t.Errorf("Folders should be reused, created %d files", len(driveService.files.created))
+	}
+}
+
+func TestGetOrCreateFolderFindsExisting(t *testing.T) {
+	driveService := newMockDriveService()
+	driveService.files.existing = []*drive.File{{Id: "existing-id", Name: "Bob's"}}
+
+	id, err := getOrCreateFolder(driveService, "Bob's", "parent")
+	if err != nil {
+		t.Fatalf("getOrCreateFolder() error: %v", err)
+	}
+	if id != "existing-id" || len(driveService.files.created) != 0 {
+		t.Errorf("getOrCreateFolder() = %s, created %d; want existing folder", id, len(driveService.files.created))
+	}
+	if !strings.Contains(driveService.files.queries[0], `name = 'Bob\'s'`) {
+		t.Errorf("Query not escaped: %s", driveService.files.queries[0])
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+const maxExternalRedirects = 5
+
+var (
+	errExternalTooLarge  = errors.New("external content exceeds the size limit")
+	errForbiddenAddress  = errors.New("external content host resolves to a non-public address")
+	errInvalidContentURL = errors.New("invalid external content URL")
+)
+
+// externalContentURL returns where to download media that LINE only holds a
+// reference to, or "" for content stored on LINE's servers.
+func externalContentURL(message webhook.MessageContentInterface) string {
+	var provider *webhook.ContentProvider
+	switch m := message.(type) {
+	case webhook.ImageMessageContent:
+		provider = m.ContentProvider
+	case webhook.VideoMessageContent:
+		provider = m.ContentProvider
+	case webhook.AudioMessageContent:
+		provider = m.ContentProvider
+	}
+	if provider == nil || provider.Type != webhook.ContentProviderTYPE_EXTERNAL {
+		return ""
+	}
+	return provider.OriginalContentUrl
+}
+
+// validateExternalURL accepts absolute HTTPS URLs without credentials
+func validateExternalURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidContentURL, err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("%w: scheme %q is not https", errInvalidContentURL, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: missing host", errInvalidContentURL)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("%w: credentials are not allowed", errInvalidContentURL)
+	}
+	return u, nil
+}
+
+// sharedAddressSpace is carrier-grade NAT space (RFC 6598), which
+// net.IP.IsPrivate does not cover
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether ip is routable on the internet. Anything else
+// could let a crafted URL reach services on the bot's own network.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip))
+}
+
+// ExternalContentClient downloads media hosted by external content providers
+type ExternalContentClient struct {
+	client  *http.Client
+	maxSize int64
+}
+
+// newExternalContentClient builds the downloader for external media. It
+// shares the blob timeouts but not the proxy: the address check happens when
+// dialing, which a proxy would bypass. allowPrivate disables that check and
+// is only meant for tests.
+func newExternalContentClient(config *Config, allowPrivate bool) *ExternalContentClient {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		// Check the address actually dialed so DNS tricks cannot sneak past
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || (!allowPrivate && !isPublicIP(ip)) {
+				return fmt.Errorf("%w: %s", errForbiddenAddress, host)
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          config.BlobMaxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: config.BlobHeaderTimeout,
+	}
+
+	return &ExternalContentClient{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.BlobTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxExternalRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxExternalRedirects)
+				}
+				_, err := validateExternalURL(req.URL.String())
+				return err
+			},
+		},
+		maxSize: config.ExternalMaxSize,
+	}
+}
+
+// Get downloads the content at rawURL. Bodies larger than the configured
+// limit fail, either up front from Content-Length or while reading.
+func (c *ExternalContentClient) Get(ctx context.Context, rawURL string) (*BlobContent, error) {
+	u, err := validateExternalURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code from external provider: %d", resp.StatusCode)
+	}
+	if c.maxSize > 0 && resp.ContentLength > c.maxSize {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %d bytes", errExternalTooLarge, resp.ContentLength)
+	}
+
+	body := resp.Body
+	if c.maxSize > 0 {
+		body = &limitedReadCloser{ReadCloser: resp.Body, remaining: c.maxSize}
+	}
+	return &BlobContent{
+		ReadCloser:    body,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: resp.ContentLength,
+	}, nil
+}
+
+// limitedReadCloser fails with errExternalTooLarge once more than remaining
+// bytes are read, rather than silently truncating like io.LimitReader.
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errExternalTooLarge
+	}
+	// Read one byte past the limit to tell "exactly at" from "over"
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errExternalTooLarge
+	}
+	return n, err
+}
+
+// openContent downloads the content of a media message, from LINE or from
+// the external provider it points to.
+func (p *Pipeline) openContent(ctx context.Context, message webhook.MessageContentInterface, messageID string) (*BlobContent, error) {
+	if contentURL := externalContentURL(message); contentURL != "" {
+		if p.external == nil {
+			return nil, fmt.Errorf("external content is not supported")
+		}
+		return p.external.Get(ctx, contentURL)
+	}
+
+	if needsTranscoding(message) {
+		if err := p.waitForTranscoding(ctx, messageID); err != nil {
+			return nil, err
+		}
+	}
+	return p.blob.GetMessageContent(ctx, messageID)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/api/drive/v3"
+)
+
+// maxFileNameBytes keeps names within what common filesystems accept
+const maxFileNameBytes = 255
+
+// Collision strategies for FILE_COLLISION, applied when a file with the same
+// name already exists in the destination folder
+const (
+	collisionSuffix    = "suffix"    // store as "name (1).ext", "name (2).ext", ...
+	collisionOverwrite = "overwrite" // replace the existing file
+	collisionVersion   = "version"   // add a revision to the existing file
+)
+
+// maxCollisionSuffix bounds the search for a free suffixed name
+const maxCollisionSuffix = 100
+
+func validateCollisionStrategy(strategy string) error {
+	switch strategy {
+	case collisionSuffix, collisionOverwrite, collisionVersion:
+		return nil
+	}
+	return fmt.Errorf("invalid FILE_COLLISION %q: must be suffix, overwrite or version", strategy)
+}
+
+// reservedNames are device names Windows refuses as file names
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFileName makes a name safe to store on any backend: Unicode NFC,
+// no path separators, reserved or control characters, no leading or
+// trailing dots and spaces, and at most maxFileNameBytes long with the
+// extension kept.
+func sanitizeFileName(name string) string {
+	name = norm.NFC.String(name)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	if name == "" {
+		return "file"
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if reservedNames[strings.ToUpper(base)] {
+		base = "_" + base
+	}
+	// An absurdly long "extension" is just part of the name
+	if len(ext) > 16 {
+		base, ext = base+ext, ""
+	}
+	if len(base)+len(ext) > maxFileNameBytes {
+		base = truncateUTF8(base, maxFileNameBytes-len(ext))
+	}
+	return base + ext
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// withSuffix turns "photo.jpg" into "photo (n).jpg"
+func withSuffix(name string, n int) string {
+	ext := path.Ext(name)
+	suffix := fmt.Sprintf(" (%d)", n)
+	base := truncateUTF8(strings.TrimSuffix(name, ext), maxFileNameBytes-len(ext)-len(suffix))
+	return base + suffix + ext
+}
+
+// filesNamed lists the files called name in folderID
+func filesNamed(driveService DriveService, folderID, name string) ([]*drive.File, error) {
+	query := fmt.Sprintf("name = '%s' and '%s' in parents and mimeType != '%s' and trashed = false",
+		escapeQueryValue(name), escapeQueryValue(folderID), folderMimeType)
+	files, err := driveService.Files().ListFiles(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up file %q: %v", name, err)
+	}
+	return files, nil
+}
+
+// replaceFile stores content as the file called name in folderID, updating
+// the existing file if there is one so links to it keep working.
+func (p *Pipeline) replaceFile(folderID, name, mimeType string, content io.Reader) error {
+	existing, err := filesNamed(p.drive, folderID, name)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		_, err = p.drive.Files().UpdateFile(existing[0].Id, &drive.File{}, content)
+	} else {
+		_, err = p.drive.Files().CreateFile(&drive.File{
+			Name:     name,
+			MimeType: mimeType,
+			Parents:  []string{folderID},
+		}, content)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", name, err)
+	}
+	return nil
+}
+
+// resolveCollision applies the configured collision strategy to a name about
+// to be stored in folderID for messageID. It returns the name to use and, for
+// the overwrite and version strategies, the files that already carry it.
+func (p *Pipeline) resolveCollision(folderID, name, messageID string) (string, []*drive.File, error) {
+	existing, err := filesNamed(p.drive, folderID, name)
+	if err != nil || len(existing) == 0 {
+		return name, nil, err
+	}
+
+	switch p.config.FileCollision {
+	case collisionOverwrite:
+		return name, existing, nil
+	case collisionVersion:
+		// Unsending removes a whole file, so a file archived from another
+		// message is not given a revision; it gets a suffix instead
+		if owner := existing[0].AppProperties[lineMessageIDProperty]; owner == "" || owner == messageID {
+			return name, existing, nil
+		}
+	}
+
+	for n := 1; n <= maxCollisionSuffix; n++ {
+		candidate := withSuffix(name, n)
+		taken, err := filesNamed(p.drive, folderID, candidate)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(taken) == 0 {
+			return candidate, nil, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no free name for %q after %d attempts", name, maxCollisionSuffix)
+}
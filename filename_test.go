@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"cafe\u0301.pdf", "caf\u00e9.pdf"}, // combining accent is composed
+		{"../../etc/passwd", "_.._etc_passwd"},
+		{`a<b>c:d"e|f?g*h\i.txt`, "a_b_c_d_e_f_g_h_i.txt"},
+		{"tab\there\x00.txt", "tab_here_.txt"},
+		{"  report.pdf. ", "report.pdf"},
+		{"CON.txt", "_CON.txt"},
+		{"...", "file"},
+		{"", "file"},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeFileName(tt.name); got != tt.want {
+			t.Errorf("sanitizeFileName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFileNameLength(t *testing.T) {
+	long := strings.Repeat("写真", 100) + ".jpg" // 3-byte characters
+	got := sanitizeFileName(long)
+	if len(got) > maxFileNameBytes {
+		t.Errorf("sanitizeFileName() is %d bytes, want at most %d", len(got), maxFileNameBytes)
+	}
+	if !strings.HasSuffix(got, ".jpg") || !utf8.ValidString(got) {
+		t.Errorf("sanitizeFileName() = %q, want valid UTF-8 ending in .jpg", got)
+	}
+}
+
+func TestWithSuffix(t *testing.T) {
+	if got := withSuffix("photo.jpg", 2); got != "photo (2).jpg" {
+		t.Errorf("withSuffix() = %q, want %q", got, "photo (2).jpg")
+	}
+	if got := withSuffix("README", 1); got != "README (1)" {
+		t.Errorf("withSuffix() = %q, want %q", got, "README (1)")
+	}
+}
+
+func TestHandleFileCollisions(t *testing.T) {
+	message := webhook.FileMessageContent{Id: "file-1", FileName: "report.pdf"}
+
+	tests := []struct {
+		strategy    string
+		wantName    string
+		wantUpdated []string
+		wantTrashed []string
+	}{
+		{collisionSuffix, "report (2).pdf", nil, nil},
+		{collisionOverwrite, "report.pdf", []string{"old-1"}, []string{"old-1"}},
+		{collisionVersion, "", []string{"old-1"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			driveService := newMockDriveService()
+			driveService.files.existing = []*drive.File{
+				{Id: "old-1", Name: "report.pdf"},
+				{Id: "old-2", Name: "report (1).pdf"},
+			}
+			config := &Config{GoogleDriveFolderID: "root-folder", FileCollision: tt.strategy}
+			pipeline := newTestPipeline(&mockBlobAPI{content: []byte("%PDF-1.4")}, driveService, config)
+
+			if _, err := pipeline.handleFile(context.Background(), message, "file-1", ".pdf", "", "root-folder",
+				GroupSettings{}, chatNames{}); err != nil {
+				t.Fatalf("handleFile() error: %v", err)
+			}
+
+			files := driveService.files
+			if tt.wantName != "" {
+				if len(files.created) != 1 || files.created[0].Name != tt.wantName {
+					t.Fatalf("created %+v, want %s", files.created, tt.wantName)
+				}
+			} else if len(files.created) != 0 {
+				t.Errorf("created %d files, want an update only", len(files.created))
+			}
+			if strings.Join(files.updated, ",") != strings.Join(tt.wantUpdated, ",") {
+				t.Errorf("updated = %v, want %v", files.updated, tt.wantUpdated)
+			}
+			if strings.Join(files.trashed, ",") != strings.Join(tt.wantTrashed, ",") {
+				t.Errorf("trashed = %v, want %v", files.trashed, tt.wantTrashed)
+			}
+		})
+	}
+}
+
+func TestVersionKeepsOtherMessagesApart(t *testing.T) {
+	message := webhook.FileMessageContent{Id: "file-2", FileName: "report.pdf"}
+	older := &drive.File{Id: "old-1", Name: "report.pdf", AppProperties: map[string]string{lineMessageIDProperty: "file-1"}}
+
+	driveService := newMockDriveService()
+	driveService.files.existing = []*drive.File{older}
+	config := &Config{GoogleDriveFolderID: "root-folder", FileCollision: collisionVersion}
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("%PDF-1.4")}, driveService, config)
+
+	if _, err := pipeline.handleFile(context.Background(), message, "file-2", ".pdf", "", "root-folder",
+		GroupSettings{}, chatNames{}); err != nil {
+		t.Fatalf("handleFile() error: %v", err)
+	}
+	files := driveService.files
+	if len(files.updated) != 0 || len(files.created) != 1 || files.created[0].Name != "report (1).pdf" {
+		t.Fatalf("updated %v and created %+v, want a new file next to the older message's", files.updated, files.created)
+	}
+
+	// Unsending the older message leaves the newer one alone
+	files.existing = append(files.existing, files.created[0])
+	if err := pipeline.handleUnsend("file-1", "group-1"); err != nil {
+		t.Fatalf("handleUnsend() error: %v", err)
+	}
+	if strings.Join(files.trashed, ",") != "old-1" {
+		t.Errorf("trashed %v, want only the older message's file", files.trashed)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// FolderCache remembers folder IDs by parent and name so repeated uploads
+// into the same folder do not have to query Drive every time.
+type FolderCache struct {
+	ids map[string]string // parentID + "/" + name -> folderID
+	mu  sync.RWMutex
+
+	// Serializes lookups that miss the cache so concurrent uploads, such as
+	// the photos of one ImageSet, do not create the same folder twice
+	createMu sync.Mutex
+}
+
+func NewFolderCache() *FolderCache {
+	return &FolderCache{
+		ids: make(map[string]string),
+	}
+}
+
+func (c *FolderCache) Get(parentID, name string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, ok := c.ids[parentID+"/"+name]
+	return id, ok
+}
+
+func (c *FolderCache) Set(parentID, name, folderID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids[parentID+"/"+name] = folderID
+}
+
+// Forget drops a folder that was moved elsewhere
+func (c *FolderCache) Forget(parentID, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ids, parentID+"/"+name)
+}
+
+// escapeQueryValue escapes a string for use inside a quoted Drive query
+func escapeQueryValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+// findFolder looks up the folder called name under parentID
+func findFolder(driveService DriveService, name, parentID string) (string, bool, error) {
+	query := fmt.Sprintf("name = '%s' and '%s' in parents and mimeType = '%s' and trashed = false",
+		escapeQueryValue(name), escapeQueryValue(parentID), folderMimeType)
+	existing, err := driveService.Files().ListFiles(query)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up folder %q: %v", name, err)
+	}
+	if len(existing) == 0 {
+		return "", false, nil
+	}
+	return existing[0].Id, true, nil
+}
+
+// getOrCreateFolder returns the ID of the folder called name under
+// parentID, creating it if it does not exist yet.
+func getOrCreateFolder(driveService DriveService, name, parentID string) (string, error) {
+	if id, ok, err := findFolder(driveService, name, parentID); err != nil || ok {
+		return id, err
+	}
+
+	folder := &drive.File{
+		Name:     name,
+		Parents:  []string{parentID},
+		MimeType: folderMimeType,
+	}
+	created, err := driveService.Files().CreateFile(folder, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create folder %q: %v", name, err)
+	}
+	return created.Id, nil
+}
+
+// folder resolves a folder under parentID through the pipeline's cache
+func (p *Pipeline) folder(name, parentID string) (string, error) {
+	if id, ok := p.folders.Get(parentID, name); ok {
+		return id, nil
+	}
+
+	p.folders.createMu.Lock()
+	defer p.folders.createMu.Unlock()
+	if id, ok := p.folders.Get(parentID, name); ok {
+		return id, nil
+	}
+
+	id, err := getOrCreateFolder(p.drive, name, parentID)
+	if err != nil {
+		return "", err
+	}
+	p.folders.Set(parentID, name, id)
+	return id, nil
+}
+
+// folderPath resolves a slash separated path such as "2024/05" under
+// parentID, creating missing folders along the way.
+func (p *Pipeline) folderPath(path, parentID string) (string, error) {
+	folderID := parentID
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		id, err := p.folder(name, folderID)
+		if err != nil {
+			return "", err
+		}
+		folderID = id
+	}
+	return folderID, nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Locales the bot can answer in
+const (
+	localeEnglish            = "en"
+	localeJapanese           = "ja"
+	localeTraditionalChinese = "zh-TW"
+	localeThai               = "th"
+)
+
+// Keys of the message catalog
+const (
+	msgHelpIntro         = "helpIntro"
+	msgAvailableCommands = "availableCommands"
+	msgHelpHelp          = "helpHelp"
+	msgHelpStats         = "helpStats"
+	msgHelpUpload        = "helpUpload"
+	msgArgCommand        = "argCommand"
+	msgArgPeriod         = "argPeriod"
+	msgUsage             = "usage"
+	msgAliases           = "aliases"
+	msgAdminOnly         = "adminOnly"
+	msgUploadsInPeriod   = "uploadsInPeriod"
+	msgWelcome           = "welcome"
+	msgUploadHelp        = "uploadHelp"
+	msgUnknownCommand    = "unknownCommand"
+	msgNotAllowed        = "notAllowed"
+	msgStatsRoom         = "statsRoom"
+	msgStatsGroup        = "statsGroup"
+	msgStatsAll          = "statsAll"
+	msgStatsChat         = "statsChat"
+	msgTotalUploads      = "totalUploads"
+	msgLastUpload        = "lastUpload"
+	msgRecentUploads     = "recentUploads"
+	msgNoRecentUploads   = "noRecentUploads"
+	msgOpenFolder        = "openFolder"
+
+	// Upload receipts
+	msgReceiptSaved     = "receiptSaved"
+	msgReceiptSavedMany = "receiptSavedMany"
+	msgReceiptMore      = "receiptMore"
+	msgNoteProcessing   = "noteProcessing"
+	msgNoteGaveUp       = "noteGaveUp"
+	msgNoteFailed       = "noteFailed"
+	msgNoteQuarantined  = "noteQuarantined"
+	msgNoteUnscanned    = "noteUnscanned"
+	msgNoteSkipped      = "noteSkipped"
+	msgYourUpload       = "yourUpload"
+	msgThisUpload       = "thisUpload"
+	msgTypeImage        = "typeImage"
+	msgTypeVideo        = "typeVideo"
+	msgTypeAudio        = "typeAudio"
+	msgTypeFile         = "typeFile"
+	msgErrTooLarge      = "errTooLarge"
+	msgErrBadLink       = "errBadLink"
+	msgErrTimeout       = "errTimeout"
+	msgErrRestarting    = "errRestarting"
+	msgErrUnknown       = "errUnknown"
+	msgErrScanTooLarge  = "errScanTooLarge"
+	msgTypeNotAllowed   = "typeNotAllowed"
+	msgFormatNotAllowed = "formatNotAllowed"
+	msgSizeOverLimit    = "sizeOverLimit"
+)
+
+// catalog holds the bot's replies per locale. English is complete; other
+// locales fall back to it for keys they lack.
+var catalog = map[string]map[string]string{
+	localeEnglish: {
+		msgHelpIntro: `📸 LINE Photo Bot
+This bot automatically saves photos and files shared in this chat to Google Drive for easy access and backup.`,
+		msgAvailableCommands: "Available commands:",
+		msgHelpHelp:          "Show this help message",
+		msgHelpStats:         "Show last 5 uploads and statistics",
+		msgHelpUpload:        "Show upload instructions",
+		msgArgCommand:        "command to explain, e.g. stats",
+		msgArgPeriod:         "count uploads in the last period, e.g. 7d or 2w",
+		msgUsage:             "Usage",
+		msgAliases:           "Also",
+		msgAdminOnly:         "Sorry, only admins can use %s.",
+		msgUploadsInPeriod:   "Uploads in the last %s",
+		msgWelcome:           "👋 Thanks for inviting me!",
+		msgUploadHelp: `📤 How to upload files:
+
+1. Simply share any photo, video, or file in this chat
+2. The bot will automatically save it to Google Drive
+3. Files are organized by group/chat
+
+Supported file types:
+• Photos (JPG, PNG, GIF, HEIC)
+• Videos (MP4, MOV)
+• Audio files (M4A)
+• Documents (PDF, etc.)`,
+		msgUnknownCommand:  "Unknown command. Type /help for available commands.",
+		msgNotAllowed:      "Sorry, you don't have permission to use this bot.",
+		msgStatsRoom:       "📊 Room Statistics",
+		msgStatsGroup:      "📊 Group Statistics",
+		msgStatsAll:        "📊 Upload Statistics",
+		msgStatsChat:       "📊 Your Statistics",
+		msgTotalUploads:    "Total uploads",
+		msgLastUpload:      "Last upload",
+		msgRecentUploads:   "Recent uploads",
+		msgNoRecentUploads: "No recent uploads found.",
+		msgOpenFolder:      "Open folder",
+
+		// Upload receipts
+		msgReceiptSaved:     "✅ Saved %s\n%s",
+		msgReceiptSavedMany: "✅ Saved %d files: %s%s\n%s",
+		msgReceiptMore:      " and %d more",
+		msgNoteProcessing:   "⏳ %s is still being processed by LINE and will be saved shortly.",
+		msgNoteGaveUp:       "❌ Could not save %s: LINE did not finish processing it.",
+		msgNoteFailed:       "❌ Could not save %s: %s.",
+		msgNoteQuarantined:  "⚠️ %s was not saved: it looks infected and was quarantined.",
+		msgNoteUnscanned:    "⚠️ %s was not saved: it is too large to be checked for viruses and was quarantined.",
+		msgNoteSkipped:      "⏭️ Not archived %s: %s.",
+		msgYourUpload:       "your %s",
+		msgThisUpload:       "this %s",
+		msgTypeImage:        "image",
+		msgTypeVideo:        "video",
+		msgTypeAudio:        "audio",
+		msgTypeFile:         "file",
+		msgErrTooLarge:      "the file is too large",
+		msgErrBadLink:       "its link cannot be downloaded",
+		msgErrTimeout:       "the download took too long",
+		msgErrRestarting:    "the bot was restarting",
+		msgErrUnknown:       "something went wrong, please send it again",
+		msgErrScanTooLarge:  "the file is too large to be checked for viruses",
+		msgTypeNotAllowed:   "%s messages are not archived in this chat",
+		msgFormatNotAllowed: "%s files are not archived in this chat",
+		msgSizeOverLimit:    "%.1f MB is over this chat's %d MB limit",
+	},
+	localeJapanese: {
+		msgHelpIntro: `📸 LINE Photo Bot
+このトークで共有された写真やファイルを自動で Google ドライブに保存し、いつでも見返せるようにバックアップします。`,
+		msgAvailableCommands: "使えるコマンド:",
+		msgHelpHelp:          "このヘルプを表示",
+		msgHelpStats:         "直近5件のアップロードと統計を表示",
+		msgHelpUpload:        "アップロード方法を表示",
+		msgArgCommand:        "説明するコマンド（例: stats）",
+		msgArgPeriod:         "指定した期間のアップロード数を表示（例: 7d、2w）",
+		msgUsage:             "使い方",
+		msgAliases:           "別名",
+		msgAdminOnly:         "申し訳ありませんが、%s は管理者のみ使えます。",
+		msgUploadsInPeriod:   "過去 %s のアップロード数",
+		msgWelcome:           "👋 招待してくれてありがとうございます！",
+		msgUploadHelp: `📤 ファイルのアップロード方法:
+
+1. このトークに写真・動画・ファイルを送るだけ
+2. ボットが自動で Google ドライブに保存します
+3. ファイルはグループ／トークごとに整理されます
+
+対応しているファイル:
+• 写真 (JPG, PNG, GIF, HEIC)
+• 動画 (MP4, MOV)
+• 音声 (M4A)
+• 書類 (PDF など)`,
+		msgUnknownCommand:  "不明なコマンドです。/help で使えるコマンドを確認できます。",
+		msgNotAllowed:      "申し訳ありませんが、このボットを使う権限がありません。",
+		msgStatsRoom:       "📊 トークルームの統計",
+		msgStatsGroup:      "📊 グループの統計",
+		msgStatsAll:        "📊 アップロード統計",
+		msgStatsChat:       "📊 あなたの統計",
+		msgTotalUploads:    "アップロード数",
+		msgLastUpload:      "最終アップロード",
+		msgRecentUploads:   "最近のアップロード",
+		msgNoRecentUploads: "最近のアップロードはありません。",
+		msgOpenFolder:      "フォルダを開く",
+
+		// Upload receipts
+		msgReceiptSaved:     "✅ %s を保存しました\n%s",
+		msgReceiptSavedMany: "✅ %d 件のファイルを保存しました: %s%s\n%s",
+		msgReceiptMore:      " ほか %d 件",
+		msgNoteProcessing:   "⏳ %s は LINE で処理中です。まもなく保存されます。",
+		msgNoteGaveUp:       "❌ %s を保存できませんでした: LINE での処理が終わりませんでした。",
+		msgNoteFailed:       "❌ %s を保存できませんでした: %s。",
+		msgNoteQuarantined:  "⚠️ %s は保存されませんでした: ウイルスの疑いがあるため隔離しました。",
+		msgNoteUnscanned:    "⚠️ %s は保存されませんでした: ウイルスチェックできないほど大きいため隔離しました。",
+		msgNoteSkipped:      "⏭️ %s は保存しませんでした: %s。",
+		msgYourUpload:       "送信された%s",
+		msgThisUpload:       "この%s",
+		msgTypeImage:        "画像",
+		msgTypeVideo:        "動画",
+		msgTypeAudio:        "音声",
+		msgTypeFile:         "ファイル",
+		msgErrTooLarge:      "ファイルが大きすぎます",
+		msgErrBadLink:       "リンクからダウンロードできません",
+		msgErrTimeout:       "ダウンロードに時間がかかりすぎました",
+		msgErrRestarting:    "ボットが再起動中でした",
+		msgErrUnknown:       "問題が発生しました。もう一度送ってください",
+		msgErrScanTooLarge:  "ウイルスチェックできないほどファイルが大きすぎます",
+		msgTypeNotAllowed:   "このトークでは%sは保存しない設定です",
+		msgFormatNotAllowed: "このトークでは %s ファイルは保存しない設定です",
+		msgSizeOverLimit:    "%.1f MB はこのトークの上限 %d MB を超えています",
+	},
+	localeTraditionalChinese: {
+		msgHelpIntro: `📸 LINE Photo Bot
+這個機器人會自動將聊天室中分享的照片和檔案儲存到 Google 雲端硬碟，方便隨時查看與備份。`,
+		msgAvailableCommands: "可用指令:",
+		msgHelpHelp:          "顯示這則說明",
+		msgHelpStats:         "顯示最近 5 筆上傳與統計",
+		msgHelpUpload:        "顯示上傳說明",
+		msgArgCommand:        "要說明的指令，例如 stats",
+		msgArgPeriod:         "統計最近一段時間的上傳數，例如 7d 或 2w",
+		msgUsage:             "用法",
+		msgAliases:           "別名",
+		msgAdminOnly:         "抱歉，只有管理員可以使用 %s。",
+		msgUploadsInPeriod:   "最近 %s 的上傳數",
+		msgWelcome:           "👋 感謝邀請我加入！",
+		msgUploadHelp: `📤 如何上傳檔案:
+
+1. 直接在聊天室分享照片、影片或檔案
+2. 機器人會自動儲存到 Google 雲端硬碟
+3. 檔案會依群組／聊天室分類
+
+支援的檔案類型:
+• 照片 (JPG, PNG, GIF, HEIC)
+• 影片 (MP4, MOV)
+• 音訊 (M4A)
+• 文件 (PDF 等)`,
+		msgUnknownCommand:  "未知的指令。輸入 /help 查看可用指令。",
+		msgNotAllowed:      "抱歉，您沒有使用此機器人的權限。",
+		msgStatsRoom:       "📊 聊天室統計",
+		msgStatsGroup:      "📊 群組統計",
+		msgStatsAll:        "📊 上傳統計",
+		msgStatsChat:       "📊 你的統計",
+		msgTotalUploads:    "上傳總數",
+		msgLastUpload:      "最後上傳",
+		msgRecentUploads:   "最近上傳",
+		msgNoRecentUploads: "沒有最近的上傳。",
+		msgOpenFolder:      "開啟資料夾",
+
+		// Upload receipts
+		msgReceiptSaved:     "✅ 已儲存 %s\n%s",
+		msgReceiptSavedMany: "✅ 已儲存 %d 個檔案：%s%s\n%s",
+		msgReceiptMore:      " 等另外 %d 個",
+		msgNoteProcessing:   "⏳ LINE 仍在處理 %s，稍後會自動儲存。",
+		msgNoteGaveUp:       "❌ 無法儲存 %s：LINE 未完成處理。",
+		msgNoteFailed:       "❌ 無法儲存 %s：%s。",
+		msgNoteQuarantined:  "⚠️ 未儲存 %s：疑似含有病毒，已隔離。",
+		msgNoteUnscanned:    "⚠️ 未儲存 %s：檔案太大無法進行病毒掃描，已隔離。",
+		msgNoteSkipped:      "⏭️ 未封存 %s：%s。",
+		msgYourUpload:       "你的%s",
+		msgThisUpload:       "這個%s",
+		msgTypeImage:        "圖片",
+		msgTypeVideo:        "影片",
+		msgTypeAudio:        "音訊",
+		msgTypeFile:         "檔案",
+		msgErrTooLarge:      "檔案太大",
+		msgErrBadLink:       "無法從連結下載",
+		msgErrTimeout:       "下載時間過長",
+		msgErrRestarting:    "機器人正在重新啟動",
+		msgErrUnknown:       "發生錯誤，請重新傳送",
+		msgErrScanTooLarge:  "檔案太大，無法進行病毒掃描",
+		msgTypeNotAllowed:   "此聊天不封存%s訊息",
+		msgFormatNotAllowed: "此聊天不封存 %s 檔案",
+		msgSizeOverLimit:    "%.1f MB 超過此聊天的 %d MB 上限",
+	},
+	localeThai: {
+		msgHelpIntro: `📸 LINE Photo Bot
+บอทนี้จะบันทึกรูปภาพและไฟล์ที่แชร์ในแชทนี้ไปยัง Google Drive โดยอัตโนมัติ เพื่อให้เข้าถึงและสำรองข้อมูลได้ง่าย`,
+		msgAvailableCommands: "คำสั่งที่ใช้ได้:",
+		msgHelpHelp:          "แสดงข้อความช่วยเหลือนี้",
+		msgHelpStats:         "แสดงการอัปโหลด 5 รายการล่าสุดและสถิติ",
+		msgHelpUpload:        "แสดงวิธีอัปโหลด",
+		msgArgCommand:        "คำสั่งที่ต้องการดูคำอธิบาย เช่น stats",
+		msgArgPeriod:         "นับการอัปโหลดในช่วงเวลาที่ผ่านมา เช่น 7d หรือ 2w",
+		msgUsage:             "วิธีใช้",
+		msgAliases:           "ชื่ออื่น",
+		msgAdminOnly:         "ขออภัย เฉพาะผู้ดูแลเท่านั้นที่ใช้ %s ได้",
+		msgUploadsInPeriod:   "อัปโหลดใน %s ที่ผ่านมา",
+		msgWelcome:           "👋 ขอบคุณที่เชิญเข้ามา!",
+		msgUploadHelp: `📤 วิธีอัปโหลดไฟล์:
+
+1. แชร์รูปภาพ วิดีโอ หรือไฟล์ในแชทนี้ได้เลย
+2. บอทจะบันทึกไปยัง Google Drive โดยอัตโนมัติ
+3. ไฟล์จะถูกจัดเก็บแยกตามกลุ่ม/แชท
+
+ประเภทไฟล์ที่รองรับ:
+• รูปภาพ (JPG, PNG, GIF, HEIC)
+• วิดีโอ (MP4, MOV)
+• ไฟล์เสียง (M4A)
+• เอกสาร (PDF ฯลฯ)`,
+		msgUnknownCommand:  "ไม่รู้จักคำสั่งนี้ พิมพ์ /help เพื่อดูคำสั่งที่ใช้ได้",
+		msgNotAllowed:      "ขออภัย คุณไม่มีสิทธิ์ใช้บอทนี้",
+		msgStatsRoom:       "📊 สถิติของห้องแชท",
+		msgStatsGroup:      "📊 สถิติของกลุ่ม",
+		msgStatsAll:        "📊 สถิติการอัปโหลด",
+		msgStatsChat:       "📊 สถิติของคุณ",
+		msgTotalUploads:    "อัปโหลดทั้งหมด",
+		msgLastUpload:      "อัปโหลดล่าสุด",
+		msgRecentUploads:   "การอัปโหลดล่าสุด",
+		msgNoRecentUploads: "ยังไม่มีการอัปโหลดล่าสุด",
+		msgOpenFolder:      "เปิดโฟลเดอร์",
+
+		// Upload receipts
+		msgReceiptSaved:     "✅ บันทึก %s แล้ว\n%s",
+		msgReceiptSavedMany: "✅ บันทึก %d ไฟล์แล้ว: %s%s\n%s",
+		msgReceiptMore:      " และอีก %d ไฟล์",
+		msgNoteProcessing:   "⏳ LINE ยังประมวลผล %s อยู่ จะบันทึกให้ในไม่ช้า",
+		msgNoteGaveUp:       "❌ บันทึก %s ไม่ได้: LINE ประมวลผลไม่เสร็จ",
+		msgNoteFailed:       "❌ บันทึก %s ไม่ได้: %s",
+		msgNoteQuarantined:  "⚠️ ไม่ได้บันทึก %s: อาจมีไวรัสจึงถูกกักกันไว้",
+		msgNoteUnscanned:    "⚠️ ไม่ได้บันทึก %s: ไฟล์ใหญ่เกินกว่าจะตรวจหาไวรัสได้จึงถูกกักกันไว้",
+		msgNoteSkipped:      "⏭️ ไม่ได้เก็บ %s: %s",
+		msgYourUpload:       "%sของคุณ",
+		msgThisUpload:       "%sนี้",
+		msgTypeImage:        "รูปภาพ",
+		msgTypeVideo:        "วิดีโอ",
+		msgTypeAudio:        "ไฟล์เสียง",
+		msgTypeFile:         "ไฟล์",
+		msgErrTooLarge:      "ไฟล์ใหญ่เกินไป",
+		msgErrBadLink:       "ดาวน์โหลดจากลิงก์ไม่ได้",
+		msgErrTimeout:       "ดาวน์โหลดนานเกินไป",
+		msgErrRestarting:    "บอตกำลังรีสตาร์ต",
+		msgErrUnknown:       "เกิดข้อผิดพลาด กรุณาส่งใหม่อีกครั้ง",
+		msgErrScanTooLarge:  "ไฟล์ใหญ่เกินกว่าจะตรวจหาไวรัสได้",
+		msgTypeNotAllowed:   "แชตนี้ไม่เก็บข้อความประเภท%s",
+		msgFormatNotAllowed: "แชตนี้ไม่เก็บไฟล์ %s",
+		msgSizeOverLimit:    "%.1f MB เกินขีดจำกัด %d MB ของแชตนี้",
+	},
+}
+
+// tr returns the catalog text for key in locale
+func tr(locale, key string) string {
+	if text, ok := catalog[locale][key]; ok {
+		return text
+	}
+	return catalog[localeEnglish][key]
+}
+
+// localized is a catalog message with its format arguments, for text that is
+// composed before the locale of the chat is known. Arguments that are
+// localized themselves are translated too.
+type localized struct {
+	key  string
+	args []interface{}
+}
+
+func localize(key string, args ...interface{}) localized {
+	return localized{key: key, args: args}
+}
+
+// text renders the message in locale
+func (l localized) text(locale string) string {
+	if len(l.args) == 0 {
+		return tr(locale, l.key)
+	}
+	args := make([]interface{}, len(l.args))
+	for i, arg := range l.args {
+		if nested, ok := arg.(localized); ok {
+			arg = nested.text(locale)
+		}
+		args[i] = arg
+	}
+	return fmt.Sprintf(tr(locale, l.key), args...)
+}
+
+// normalizeLocale maps a language tag, as in LINE profiles, to a supported
+// locale, or "" if the bot does not speak it.
+func normalizeLocale(language string) string {
+	tag := strings.ToLower(strings.ReplaceAll(language, "_", "-"))
+	switch {
+	case tag == "":
+		return ""
+	case tag == "ja" || strings.HasPrefix(tag, "ja-"):
+		return localeJapanese
+	case tag == "th" || strings.HasPrefix(tag, "th-"):
+		return localeThai
+	case tag == "zh-tw" || tag == "zh-hk" || strings.HasPrefix(tag, "zh-hant"):
+		return localeTraditionalChinese
+	case tag == "en" || strings.HasPrefix(tag, "en-"):
+		return localeEnglish
+	}
+	return ""
+}
+
+func validateLanguage(language string) error {
+	if language != "" && normalizeLocale(language) == "" {
+		return fmt.Errorf("invalid language %q: must be en, ja, zh-TW or th", language)
+	}
+	return nil
+}
+
+var thaiMonths = [...]string{"ม.ค.", "ก.พ.", "มี.ค.", "เม.ย.", "พ.ค.", "มิ.ย.", "ก.ค.", "ส.ค.", "ก.ย.", "ต.ค.", "พ.ย.", "ธ.ค."}
+
+// formatDateTime renders a date and time the way locale writes them. Thai
+// dates use the Buddhist era.
+func formatDateTime(locale string, t time.Time) string {
+	switch locale {
+	case localeJapanese, localeTraditionalChinese:
+		return t.Format("2006年1月2日 15:04:05")
+	case localeThai:
+		return fmt.Sprintf("%d %s %d %s", t.Day(), thaiMonths[t.Month()-1], t.Year()+543, t.Format("15:04:05"))
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// formatShortDateTime is formatDateTime without the year and seconds
+func formatShortDateTime(locale string, t time.Time) string {
+	switch locale {
+	case localeJapanese, localeTraditionalChinese:
+		return t.Format("1/2 15:04")
+	case localeThai:
+		return fmt.Sprintf("%d %s %s", t.Day(), thaiMonths[t.Month()-1], t.Format("15:04"))
+	}
+	return t.Format("01-02 15:04")
+}
+
+// chatLocale picks the language to answer a chat in: the chat's language
+// setting, else the language of the sender's LINE profile, else English.
+func (p *Pipeline) chatLocale(userID, groupID string) string {
+	if locale := normalizeLocale(p.settings.ForGroup(groupID).Language); locale != "" {
+		return locale
+	}
+	if userID == "" || p.profiles == nil {
+		return localeEnglish
+	}
+	// The profile language is only visible for users who added the bot
+	language := p.names.lookup("language:"+userID, "", func() (string, error) {
+		profile, err := p.profiles.GetProfile(userID)
+		if err != nil {
+			return "", err
+		}
+		return profile.Language, nil
+	})
+	if locale := normalizeLocale(language); locale != "" {
+		return locale
+	}
+	return localeEnglish
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeLocale(t *testing.T) {
+	tests := map[string]string{
+		"ja":      localeJapanese,
+		"ja-JP":   localeJapanese,
+		"zh-TW":   localeTraditionalChinese,
+		"zh-Hant": localeTraditionalChinese,
+		"th":      localeThai,
+		"en-US":   localeEnglish,
+		"zh-CN":   "",
+		"ko":      "",
+		"":        "",
+	}
+	for language, want := range tests {
+		if got := normalizeLocale(language); got != want {
+			t.Errorf("normalizeLocale(%q) = %q, want %q", language, got, want)
+		}
+	}
+}
+
+func TestCatalogIsComplete(t *testing.T) {
+	for locale, messages := range catalog {
+		for key := range catalog[localeEnglish] {
+			if messages[key] == "" {
+				t.Errorf("%s has no %s message", locale, key)
+			}
+		}
+	}
+}
+
+func TestFormatDateTime(t *testing.T) {
+	at := time.Date(2024, time.March, 5, 14, 7, 9, 0, time.UTC)
+	tests := map[string]string{
+		localeEnglish:            "2024-03-05 14:07:09",
+		localeJapanese:           "2024年3月5日 14:07:09",
+		localeTraditionalChinese: "2024年3月5日 14:07:09",
+		localeThai:               "5 มี.ค. 2567 14:07:09",
+	}
+	for locale, want := range tests {
+		if got := formatDateTime(locale, at); got != want {
+			t.Errorf("formatDateTime(%s) = %q, want %q", locale, got, want)
+		}
+	}
+}
+
+func TestChatLocale(t *testing.T) {
+	pipeline := newTestPipeline(&mockBlobAPI{}, newMockDriveService(), newTestConfig())
+	pipeline.profiles = &mockProfileAPI{}
+	pipeline.settings.groups["group-th"] = GroupSettings{Language: "th"}
+
+	if got := pipeline.chatLocale("user-1", "group-th"); got != localeThai {
+		t.Errorf("chatLocale() = %q, want the group setting", got)
+	}
+	if got := pipeline.chatLocale("user-1", "group-1"); got != localeJapanese {
+		t.Errorf("chatLocale() = %q, want the profile language", got)
+	}
+	if got := pipeline.chatLocale("", "group-1"); got != localeEnglish {
+		t.Errorf("chatLocale() = %q, want English without a sender", got)
+	}
+}
+
+func TestLocalizedStats(t *testing.T) {
+	bot := newMockBot()
+	groupCache := NewGroupCache()
+	groupCache.AddUploadedFile("group-1", "a.jpg", "")
+
+	handleCommand(bot, "/stats", "", "group-1", "reply-token", groupCache, localeJapanese, false)
+	if len(bot.sentMessages) != 1 || !strings.Contains(bot.sentMessages[0], "グループの統計") || !strings.Contains(bot.sentMessages[0], "アップロード数: 1") {
+		t.Errorf("sent %v, want Japanese stats", bot.sentMessages)
+	}
+
+	handleCommand(bot, "/nope", "", "group-1", "reply-token", groupCache, localeThai, false)
+	if got := bot.sentMessages[len(bot.sentMessages)-1]; got != catalog[localeThai][msgUnknownCommand] {
+		t.Errorf("unknown command reply = %q, want Thai", got)
+	}
+}
+
+func TestLoadSettingsRejectsInvalidLanguage(t *testing.T) {
+	path := t.TempDir() + "/settings.json"
+	writeJSONFile(path, map[string]interface{}{
+		"default": map[string]interface{}{"language": "klingon"},
+	})
+
+	if _, err := loadSettings(path); err == nil {
+		t.Error("loadSettings() accepted an unknown language")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+func TestHandleFileImageSet(t *testing.T) {
+	driveService := newMockDriveService()
+	config := &Config{GoogleDriveFolderID: "root-folder"}
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("fake photo")}, driveService, config)
+
+	for i := int32(1); i <= 2; i++ {
+		message := webhook.ImageMessageContent{
+			Id:       fmt.Sprintf("img-%d", i),
+			ImageSet: &webhook.ImageSet{Id: "0123456789ABCDEF0123", Index: i, Total: 2},
+		}
+		if _, err := pipeline.handleFile(context.Background(), message, message.Id, ".jpg", "", "root-folder", GroupSettings{}, chatNames{}); err != nil {
+			t.Fatalf("handleFile() error: %v", err)
+		}
+	}
+
+	// One shared folder followed by both photos
+	created := driveService.files.created
+	if len(created) != 3 {
+		t.Fatalf("Created %d files, want 3", len(created))
+	}
+	if created[0].Name != "ImageSet-0123456789AB" || created[0].Parents[0] != "root-folder" {
+		t.Errorf("Set folder = %s in %v, want ImageSet-0123456789AB in root-folder", created[0].Name, created[0].Parents)
+	}
+	for i, photo := range created[1:] {
+		wantPrefix := []string{"01-line-file-", "02-line-file-"}[i]
+		if !strings.HasPrefix(photo.Name, wantPrefix) {
+			t.Errorf("Photo name = %s, want prefix %s", photo.Name, wantPrefix)
+		}
+		if photo.Parents[0] != "mock-file-id" {
+			t.Errorf("Photo parent = %v, want the set folder", photo.Parents)
+		}
+	}
+}
+
+func TestProcessUploadCountsImageSetOnce(t *testing.T) {
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("fake photo")}, newMockDriveService(), newTestConfig())
+
+	for _, id := range []string{"img-1", "img-2", "img-3"} {
+		job := UploadJob{MessageID: id, Type: "image", GroupID: "group-1",
+			ImageSetID: "set-1", ImageSetTotal: 3}
+		if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+			t.Fatalf("processUpload() error: %v", err)
+		}
+	}
+
+	uploads, _, recent := pipeline.groupCache.GetStats("group-1")
+	if uploads != 1 {
+		t.Errorf("TotalUploads = %d, want 1", uploads)
+	}
+	if len(recent) != 1 || recent[0].Name != "ImageSet-set-1 (3 photos)" {
+		t.Errorf("RecentFiles = %+v, want the set once", recent)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+const placesDir = "places" // inside Config.StateDir
+
+// Map formats for the locations group setting
+const (
+	locationsGPX = "gpx"
+	locationsKML = "kml"
+	locationsOff = "off"
+)
+
+func validateLocationsFormat(format string) error {
+	switch format {
+	case "", locationsGPX, locationsKML, locationsOff:
+		return nil
+	}
+	return fmt.Errorf("invalid locations format %q: must be gpx, kml or off", format)
+}
+
+// sharedPlace is a location shared in a chat
+type sharedPlace struct {
+	MessageID string    `json:"messageId"`
+	Title     string    `json:"title,omitempty"`
+	Address   string    `json:"address,omitempty"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	SenderID  string    `json:"senderId,omitempty"`
+	Sender    string    `json:"sender,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// name is what the place is labeled with on a map
+func (s sharedPlace) name() string {
+	if s.Title != "" {
+		return s.Title
+	}
+	if s.Address != "" {
+		return s.Address
+	}
+	return "Shared location"
+}
+
+// description says who shared the place and where it is
+func (s sharedPlace) description() string {
+	desc := "Shared by " + s.Sender
+	if s.Address != "" && s.Address != s.name() {
+		desc = s.Address + "\n" + desc
+	}
+	return desc
+}
+
+// Places keeps every location shared in each chat on disk, since the map
+// files in Drive are rewritten from scratch on every new place.
+//
+// Layout: <dir>/<chat folder ID>.json
+type Places struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewPlaces(dir string) *Places {
+	return &Places{dir: dir}
+}
+
+// Add stores a place for the chat whose folder is folderID and hands every
+// place of the chat to publish. Places already stored are ignored. The lock
+// is held while publishing so maps are written in order.
+func (pl *Places) Add(folderID string, place sharedPlace, publish func([]sharedPlace) error) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	path := filepath.Join(pl.dir, folderID+".json")
+	var places []sharedPlace
+	if err := readJSONFile(path, &places); err != nil {
+		return fmt.Errorf("failed to read places: %v", err)
+	}
+	for _, existing := range places {
+		if existing.MessageID == place.MessageID {
+			return nil
+		}
+	}
+
+	places = append(places, place)
+	if err := writeJSONFile(path, places); err != nil {
+		return fmt.Errorf("failed to save places: %v", err)
+	}
+	return publish(places)
+}
+
+// RemoveMessage drops the place shared in messageID from whichever chat has
+// it and hands that chat's remaining places to publish.
+func (pl *Places) RemoveMessage(messageID string, publish func(folderID string, places []sharedPlace) error) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(pl.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		var places []sharedPlace
+		if err := readJSONFile(path, &places); err != nil {
+			return fmt.Errorf("failed to read places: %v", err)
+		}
+		kept := places[:0]
+		for _, place := range places {
+			if place.MessageID != messageID {
+				kept = append(kept, place)
+			}
+		}
+		if len(kept) == len(places) {
+			continue
+		}
+		if err := writeJSONFile(path, kept); err != nil {
+			return fmt.Errorf("failed to save places: %v", err)
+		}
+		return publish(strings.TrimSuffix(filepath.Base(path), ".json"), kept)
+	}
+	return nil
+}
+
+type gpxFile struct {
+	XMLName   xml.Name      `xml:"gpx"`
+	Version   string        `xml:"version,attr"`
+	Creator   string        `xml:"creator,attr"`
+	Namespace string        `xml:"xmlns,attr"`
+	Name      string        `xml:"metadata>name"`
+	Waypoints []gpxWaypoint `xml:"wpt"`
+}
+
+type gpxWaypoint struct {
+	Latitude    string `xml:"lat,attr"`
+	Longitude   string `xml:"lon,attr"`
+	Time        string `xml:"time"`
+	Name        string `xml:"name"`
+	Description string `xml:"desc"`
+}
+
+type kmlFile struct {
+	XMLName    xml.Name       `xml:"kml"`
+	Namespace  string         `xml:"xmlns,attr"`
+	Name       string         `xml:"Document>name"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string `xml:"name"`
+	Description string `xml:"description"`
+	Address     string `xml:"address,omitempty"`
+	When        string `xml:"TimeStamp>when"`
+	Coordinates string `xml:"Point>coordinates"`
+}
+
+func formatCoordinate(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// renderPlaces writes the places as a GPX or KML document titled title
+func renderPlaces(places []sharedPlace, format, title string) ([]byte, error) {
+	var doc interface{}
+	if format == locationsKML {
+		kml := kmlFile{Namespace: "http://www.opengis.net/kml/2.2", Name: title}
+		for _, place := range places {
+			kml.Placemarks = append(kml.Placemarks, kmlPlacemark{
+				Name:        place.name(),
+				Description: place.description(),
+				Address:     place.Address,
+				When:        place.Time.Format(time.RFC3339),
+				// KML puts longitude first
+				Coordinates: formatCoordinate(place.Longitude) + "," + formatCoordinate(place.Latitude),
+			})
+		}
+		doc = kml
+	} else {
+		gpx := gpxFile{Version: "1.1", Creator: "line-photo-bot", Namespace: "http://www.topografix.com/GPX/1/1", Name: title}
+		for _, place := range places {
+			gpx.Waypoints = append(gpx.Waypoints, gpxWaypoint{
+				Latitude:    formatCoordinate(place.Latitude),
+				Longitude:   formatCoordinate(place.Longitude),
+				Time:        place.Time.UTC().Format(time.RFC3339),
+				Name:        place.name(),
+				Description: place.description(),
+			})
+		}
+		doc = gpx
+	}
+
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// placesFileName names a chat's map file
+func placesFileName(format string) (name, mimeType string) {
+	if format == locationsKML {
+		return "locations.kml", "application/vnd.google-earth.kml+xml"
+	}
+	return "locations.gpx", "application/gpx+xml"
+}
+
+// publishPlaces rewrites a chat's map file with its places
+func (p *Pipeline) publishPlaces(folderID, format, group string, places []sharedPlace) error {
+	data, err := renderPlaces(places, format, "Places shared in "+group)
+	if err != nil {
+		return err
+	}
+	name, mimeType := placesFileName(format)
+	return p.replaceFile(folderID, name, mimeType, bytes.NewReader(data))
+}
+
+// recordLocation adds a shared location to its group's map file, if the
+// group turned maps on. Only groups and rooms have maps, and privacy groups
+// never do: a map of where members went is what privacy strips from photos.
+func (p *Pipeline) recordLocation(message webhook.LocationMessageContent, userID, groupID string, sent time.Time) {
+	settings := p.settings.ForGroup(groupID)
+	if groupID == "" || settings.Locations == "" || settings.Locations == locationsOff || settings.Privacy || p.places == nil {
+		return
+	}
+
+	folderID, err := p.chatFolder(userID, groupID)
+	if err != nil {
+		log.Printf("Error resolving folder for locations of %s: %v", groupID, err)
+		return
+	}
+	names := p.lookupNames(userID, groupID)
+	place := sharedPlace{
+		MessageID: message.Id,
+		Title:     message.Title,
+		Address:   message.Address,
+		Latitude:  message.Latitude,
+		Longitude: message.Longitude,
+		SenderID:  userID,
+		Sender:    names.Sender,
+		Time:      sent,
+	}
+
+	err = p.places.Add(folderID, place, func(places []sharedPlace) error {
+		return p.publishPlaces(folderID, settings.Locations, names.Group, places)
+	})
+	if err != nil {
+		log.Printf("Error recording location %s: %v", message.Id, err)
+		return
+	}
+	log.Printf("Location recorded for %s: %s", groupID, place.name())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestRenderPlaces(t *testing.T) {
+	places := []sharedPlace{{
+		MessageID: "loc-1",
+		Title:     "Tokyo Tower",
+		Address:   "4 Chome-2-8 Shibakoen, Minato City",
+		Latitude:  35.6586,
+		Longitude: 139.7454,
+		Sender:    "Alice & Bob",
+		Time:      time.Date(2024, 5, 16, 9, 30, 0, 0, time.UTC),
+	}}
+
+	gpx, err := renderPlaces(places, locationsGPX, "Trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsedGPX gpxFile
+	if err := xml.Unmarshal(gpx, &parsedGPX); err != nil {
+		t.Fatalf("GPX does not parse: %v", err)
+	}
+	wpt := parsedGPX.Waypoints[0]
+	if wpt.Latitude != "35.6586" || wpt.Longitude != "139.7454" || wpt.Name != "Tokyo Tower" {
+		t.Errorf("waypoint = %+v", wpt)
+	}
+	if !strings.Contains(wpt.Description, "Shared by Alice & Bob") {
+		t.Errorf("description = %q, want the sender", wpt.Description)
+	}
+
+	kml, err := renderPlaces(places, locationsKML, "Trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsedKML kmlFile
+	if err := xml.Unmarshal(kml, &parsedKML); err != nil {
+		t.Fatalf("KML does not parse: %v", err)
+	}
+	if got := parsedKML.Placemarks[0].Coordinates; got != "139.7454,35.6586" {
+		t.Errorf("coordinates = %q, want longitude first", got)
+	}
+}
+
+func TestRecordLocation(t *testing.T) {
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{}, driveService, newTestConfig())
+	pipeline.places = NewPlaces(t.TempDir())
+	pipeline.settings.groups["group-1"] = GroupSettings{Locations: locationsGPX}
+	pipeline.settings.groups["group-kml"] = GroupSettings{Locations: locationsKML}
+	pipeline.settings.groups["group-off"] = GroupSettings{Locations: locationsOff}
+
+	sent := time.Date(2024, 5, 16, 9, 30, 0, 0, time.UTC)
+	first := webhook.LocationMessageContent{Id: "loc-1", Title: "Station", Latitude: 1, Longitude: 2}
+	second := webhook.LocationMessageContent{Id: "loc-2", Address: "Harbor", Latitude: 3, Longitude: 4}
+
+	pipeline.recordLocation(first, "user-1", "group-off", sent)
+	pipeline.recordLocation(first, "user-1", "group-1", sent)
+	files := driveService.files
+	last := files.created[len(files.created)-1]
+	if last.Name != "locations.gpx" {
+		t.Fatalf("created %q, want locations.gpx", last.Name)
+	}
+
+	// A new place rewrites the map with every place; a redelivery changes nothing
+	files.existing = []*drive.File{last}
+	pipeline.recordLocation(second, "user-1", "group-1", sent)
+	pipeline.recordLocation(second, "user-1", "group-1", sent)
+	if len(files.updated) != 1 {
+		t.Fatalf("updated %d times, want 1", len(files.updated))
+	}
+	var gpx gpxFile
+	if err := xml.Unmarshal(files.uploaded[len(files.uploaded)-1], &gpx); err != nil {
+		t.Fatal(err)
+	}
+	if len(gpx.Waypoints) != 2 || gpx.Waypoints[1].Name != "Harbor" {
+		t.Errorf("waypoints = %+v, want both places", gpx.Waypoints)
+	}
+
+	// The mock gives every folder the same ID, so use a new message
+	pipeline.recordLocation(webhook.LocationMessageContent{Id: "loc-3", Latitude: 5, Longitude: 6}, "user-1", "group-kml", sent)
+	if last := files.created[len(files.created)-1]; last.Name != "locations.kml" {
+		t.Errorf("created %q, want locations.kml", last.Name)
+	}
+}
+
+func TestRecordLocationIsOptIn(t *testing.T) {
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{}, driveService, newTestConfig())
+	pipeline.places = NewPlaces(t.TempDir())
+	pipeline.settings.groups["group-private"] = GroupSettings{Locations: locationsGPX, Privacy: true}
+
+	place := webhook.LocationMessageContent{Id: "loc-1", Title: "Home", Latitude: 1, Longitude: 2}
+	pipeline.recordLocation(place, "user-1", "group-default", time.Now())
+	pipeline.recordLocation(place, "user-1", "group-private", time.Now())
+	if len(driveService.files.created) != 0 {
+		t.Errorf("created %+v, want no map without the setting or with privacy", driveService.files.created)
+	}
+}
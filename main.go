@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jeffreywu1996/line-photo-bot/middleware"
@@ -52,88 +57,21 @@ func (c *MessageCache) MarkProcessed(messageID string) {
 	}
 }
 
-// Update handleCommand function
-func handleCommand(bot MessageSender, text, groupID, replyToken string, groupCache *GroupCache) {
-	switch text {
-	case "/help":
-		sendMessage(bot, replyToken, `📸 LINE Photo Bot
-This bot automatically saves photos and files shared in this chat to Google Drive for easy access and backup.
-
-Available commands:
-/help - Show this help message
-/stats - Show last 5 uploads and statistics
-/upload - Show upload instructions`)
-
-	case "/stats":
-		var uploads int
-		var lastUpload time.Time
-		var recentFiles []FileInfo
-
-		if groupID != "" {
-			// Get group stats
-			uploads, lastUpload, recentFiles = groupCache.GetStats(groupID)
-		} else {
-			// Get global stats (all uploads)
-			uploads, lastUpload, recentFiles = groupCache.GetGlobalStats()
-		}
-
-		// Format recent files list
-		var recentFilesList string
-		if len(recentFiles) > 0 {
-			recentFilesList = "\n\nRecent uploads:"
-			for _, file := range recentFiles {
-				recentFilesList += fmt.Sprintf("\n%s - %s",
-					file.Timestamp.Format("2006-01-02 15:04:05"),
-					file.Name)
-			}
-		} else {
-			recentFilesList = "\n\nNo recent uploads found."
-		}
-
-		var statsTitle string
-		if groupID != "" {
-			statsTitle = "📊 Group Statistics"
-		} else {
-			statsTitle = "📊 Upload Statistics"
-		}
-
-		msg := fmt.Sprintf("%s\nTotal uploads: %d\nLast upload: %s%s",
-			statsTitle,
-			uploads,
-			lastUpload.Format("2006-01-02 15:04:05"),
-			recentFilesList)
-		sendMessage(bot, replyToken, msg)
-
-	case "/upload":
-		sendMessage(bot, replyToken, `📤 How to upload files:
-
-1. Simply share any photo, video, or file in this chat
-2. The bot will automatically save it to Google Drive
-3. Files are organized by group/chat
-
-Supported file types:
-• Photos (JPG)
-• Videos (MP4)
-• Audio files (M4A)
-• Documents (PDF, etc.)`)
-
-	default:
-		if strings.HasPrefix(text, "/") {
-			sendMessage(bot, replyToken, "Unknown command. Type /help for available commands.")
-		}
-	}
-}
-
 // Update GroupStats struct to track recent files
 type FileInfo struct {
 	Name      string
 	Timestamp time.Time
+	URL       string // Drive link, for files uploaded since links were tracked
 }
 
 type GroupStats struct {
 	TotalUploads int
 	LastUpload   time.Time
-	RecentFiles  []FileInfo // Keep track of recent files
+	RecentFiles  []FileInfo           // Keep track of recent files
+	ImageSets    map[string]time.Time // ImageSet ID -> first seen, to count each set once
+	ArchivedAt   time.Time            // When the bot left the group; zero while it is a member
+	FolderID     string               // Drive folder of the group, once something was uploaded
+	Daily        map[string]int       // Uploads per day (2006-01-02), for the last dailyStatsDays days
 	mu           sync.RWMutex
 }
 
@@ -162,9 +100,10 @@ func (c *GroupCache) IncrementUploads(groupID string) {
 
 	stats.TotalUploads++
 	stats.LastUpload = time.Now()
+	stats.countDaily(stats.LastUpload)
 }
 
-func (c *GroupCache) AddUploadedFile(groupID, fileName string) {
+func (c *GroupCache) AddUploadedFile(groupID, fileName, url string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -178,11 +117,13 @@ func (c *GroupCache) AddUploadedFile(groupID, fileName string) {
 
 	stats.TotalUploads++
 	stats.LastUpload = time.Now()
+	stats.countDaily(stats.LastUpload)
 
 	// Add new file to recent files
 	newFile := FileInfo{
 		Name:      fileName,
 		Timestamp: time.Now(),
+		URL:       url,
 	}
 
 	// Keep only last 5 files
@@ -192,6 +133,169 @@ func (c *GroupCache) AddUploadedFile(groupID, fileName string) {
 	}
 }
 
+// dailyStatsDays is how long per-day upload counts are kept for /stats periods
+const dailyStatsDays = 366
+
+// countDaily adds an upload at t to the per-day counts and drops days that
+// are too old to ask for. The caller holds s.mu.
+func (s *GroupStats) countDaily(t time.Time) {
+	if s.Daily == nil {
+		s.Daily = make(map[string]int)
+	}
+	s.Daily[t.Format("2006-01-02")]++
+	oldest := t.AddDate(0, 0, -dailyStatsDays).Format("2006-01-02")
+	for day := range s.Daily {
+		if day < oldest {
+			delete(s.Daily, day)
+		}
+	}
+}
+
+// uploadsSince counts the uploads on the days from since's day onwards. The
+// caller holds s.mu for reading.
+func (s *GroupStats) uploadsSince(since time.Time) int {
+	first := since.Format("2006-01-02")
+	total := 0
+	for day, count := range s.Daily {
+		if day >= first {
+			total += count
+		}
+	}
+	return total
+}
+
+// UploadsSince counts a group's uploads from the day of since onwards
+func (c *GroupCache) UploadsSince(groupID string, since time.Time) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if stats, exists := c.stats[groupID]; exists {
+		stats.mu.RLock()
+		defer stats.mu.RUnlock()
+		return stats.uploadsSince(since)
+	}
+	return 0
+}
+
+// GlobalUploadsSince is UploadsSince over all groups
+func (c *GroupCache) GlobalUploadsSince(since time.Time) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	total := 0
+	for _, stats := range c.stats {
+		stats.mu.RLock()
+		total += stats.uploadsSince(since)
+		stats.mu.RUnlock()
+	}
+	return total
+}
+
+// AddImageSet records a photo that was sent as part of an ImageSet. The set
+// counts as a single upload, recorded when its first photo arrives.
+func (c *GroupCache) AddImageSet(groupID, setID, name, url string) {
+	c.mu.Lock()
+	if _, exists := c.stats[groupID]; !exists {
+		c.stats[groupID] = &GroupStats{}
+	}
+	stats := c.stats[groupID]
+	c.mu.Unlock()
+
+	stats.mu.Lock()
+	if stats.ImageSets == nil {
+		stats.ImageSets = make(map[string]time.Time)
+	}
+	_, seen := stats.ImageSets[setID]
+	if !seen {
+		stats.ImageSets[setID] = time.Now()
+	}
+	// Photos of a set arrive within seconds; forget sets after a day
+	for id, t := range stats.ImageSets {
+		if time.Since(t) > 24*time.Hour {
+			delete(stats.ImageSets, id)
+		}
+	}
+	stats.mu.Unlock()
+
+	if !seen {
+		c.AddUploadedFile(groupID, name, url)
+	}
+}
+
+// RemoveRecentFile drops the file linked at url from every chat's recent
+// files. The upload still counts.
+func (c *GroupCache) RemoveRecentFile(url string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, stats := range c.stats {
+		stats.mu.Lock()
+		kept := stats.RecentFiles[:0]
+		for _, file := range stats.RecentFiles {
+			if file.URL != url {
+				kept = append(kept, file)
+			}
+		}
+		stats.RecentFiles = kept
+		stats.mu.Unlock()
+	}
+}
+
+// SetArchived records when the bot left a group, or clears it with a zero
+// time when the bot joins again.
+func (c *GroupCache) SetArchived(groupID string, at time.Time) {
+	c.mu.Lock()
+	if _, exists := c.stats[groupID]; !exists {
+		c.stats[groupID] = &GroupStats{}
+	}
+	stats := c.stats[groupID]
+	c.mu.Unlock()
+
+	stats.mu.Lock()
+	stats.ArchivedAt = at
+	stats.mu.Unlock()
+}
+
+// SetFolder records the Drive folder a group is archived in
+func (c *GroupCache) SetFolder(groupID, folderID string) {
+	c.mu.Lock()
+	if _, exists := c.stats[groupID]; !exists {
+		c.stats[groupID] = &GroupStats{}
+	}
+	stats := c.stats[groupID]
+	c.mu.Unlock()
+
+	stats.mu.Lock()
+	stats.FolderID = folderID
+	stats.mu.Unlock()
+}
+
+// Folder returns the Drive folder of a group, or "" if it is not known yet
+func (c *GroupCache) Folder(groupID string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if stats, exists := c.stats[groupID]; exists {
+		stats.mu.RLock()
+		defer stats.mu.RUnlock()
+		return stats.FolderID
+	}
+	return ""
+}
+
+// ArchivedAt returns when the bot left a group, or zero if it has not
+func (c *GroupCache) ArchivedAt(groupID string) time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if stats, exists := c.stats[groupID]; exists {
+		stats.mu.RLock()
+		defer stats.mu.RUnlock()
+		return stats.ArchivedAt
+	}
+	return time.Time{}
+}
+
 func (c *GroupCache) GetStats(groupID string) (int, time.Time, []FileInfo) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -244,7 +348,53 @@ type Config struct {
 	GoogleCredentials   string
 	GoogleDriveFolderID string
 	Port                string
-	AdminUsers          []string // List of user IDs who have admin privileges
+	AdminUsers          []string      // List of user IDs who have admin privileges
+	DateFolderFormat    string        // Go time layout for date subfolders, e.g. "2006/01"; empty disables them
+	GroupSettingsFile   string        // JSON file with per-group settings; empty uses defaults everywhere
+	ShutdownTimeout     time.Duration // Grace period for in-flight uploads on shutdown
+	StateDir            string        // Directory where caches and pending uploads are persisted
+	ThumbnailSize       int           // Longest side of generated thumbnails, in pixels
+
+	// HTTP settings for LINE content downloads
+	BlobTimeout       time.Duration // Overall limit for a single download
+	BlobHeaderTimeout time.Duration // Limit for waiting on response headers
+	BlobMaxIdleConns  int           // Keep-alive connections kept in the pool
+	BlobProxyURL      string        // Proxy for downloads, defaults to HTTP(S)_PROXY
+	ExternalMaxSize   int64         // Size limit for media from external content providers, in bytes
+	TranscodeWait     time.Duration // How long to wait for LINE to prepare videos and audio before requeueing
+	FileNameTemplate  string        // Template for archived file names, e.g. "{date}-{sender}-{id}"; empty keeps the defaults
+	FileCollision     string        // What to do when a name is taken: suffix, overwrite or version
+
+	ClamAVAddress      string // clamd to scan downloads with, e.g. "tcp://clamav:3310"; empty disables scanning
+	QuarantineFolderID string // Drive folder for infected files; required with ClamAVAddress
+	ClamAVOversize     string // what to do with content too large for clamd: skip, quarantine or upload
+	UnsentFolderID     string // Drive folder for files whose message was unsent; empty moves them to the trash
+	ArchiveFolderID    string // Drive folder that folders of groups the bot leaves are moved into; empty leaves them
+}
+
+// getEnvDuration parses a duration such as "30s" from the environment
+func getEnvDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return d, nil
+}
+
+func getEnvInt(key string, defaultValue int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return n, nil
 }
 
 func loadConfig() (*Config, error) {
@@ -258,6 +408,17 @@ func loadConfig() (*Config, error) {
 		GoogleCredentials:   os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"),
 		GoogleDriveFolderID: os.Getenv("GOOGLE_DRIVE_FOLDER_ID"),
 		Port:                os.Getenv("PORT"),
+		StateDir:            os.Getenv("STATE_DIR"),
+		DateFolderFormat:    os.Getenv("DATE_FOLDER_FORMAT"),
+		GroupSettingsFile:   os.Getenv("GROUP_SETTINGS_FILE"),
+		BlobProxyURL:        os.Getenv("LINE_BLOB_PROXY"),
+		FileNameTemplate:    os.Getenv("FILE_NAME_TEMPLATE"),
+		FileCollision:       os.Getenv("FILE_COLLISION"),
+		ClamAVAddress:       os.Getenv("CLAMAV_ADDRESS"),
+		QuarantineFolderID:  os.Getenv("QUARANTINE_FOLDER_ID"),
+		ClamAVOversize:      os.Getenv("CLAMAV_OVERSIZE"),
+		UnsentFolderID:      os.Getenv("UNSENT_FOLDER_ID"),
+		ArchiveFolderID:     os.Getenv("ARCHIVE_FOLDER_ID"),
 	}
 
 	// Validate required fields
@@ -270,40 +431,69 @@ func loadConfig() (*Config, error) {
 		config.Port = "3000"
 	}
 
-	// Load admin users from env var (comma-separated list)
-	adminUsersStr := os.Getenv("ADMIN_USERS")
-	if adminUsersStr != "" {
-		config.AdminUsers = strings.Split(adminUsersStr, ",")
+	if config.StateDir == "" {
+		config.StateDir = "data"
 	}
 
-	return config, nil
-}
-
-// Update the interface to match the SDK
-type BlobAPI interface {
-	GetMessageContent(messageID string) (io.ReadCloser, error)
-}
-
-// Update the real implementation
-type realBlobAPI struct {
-	api *messaging_api.MessagingApiBlobAPI
-}
-
-func (r *realBlobAPI) GetMessageContent(messageID string) (io.ReadCloser, error) {
-	resp, err := r.api.GetMessageContent(messageID)
-	if err != nil {
+	if err := validateFileNameTemplate(config.FileNameTemplate); err != nil {
+		return nil, err
+	}
+	if config.FileCollision == "" {
+		config.FileCollision = collisionSuffix
+	}
+	if err := validateCollisionStrategy(config.FileCollision); err != nil {
+		return nil, err
+	}
+	// A folder inside GOOGLE_DRIVE_FOLDER_ID would share infected files with
+	// everyone who can see the archive
+	if config.ClamAVAddress != "" && config.QuarantineFolderID == "" {
+		return nil, fmt.Errorf("CLAMAV_ADDRESS requires QUARANTINE_FOLDER_ID")
+	}
+	if config.ClamAVOversize == "" {
+		config.ClamAVOversize = oversizeSkip
+	}
+	if err := validateOversizePolicy(config.ClamAVOversize); err != nil {
 		return nil, err
 	}
-	return resp.Body, nil
-}
 
-// Provide a function we can override in tests:
-var NewBlobAPI = func(channelToken string) (BlobAPI, error) {
-	api, err := messaging_api.NewMessagingApiBlobAPI(channelToken)
+	var err error
+	if config.ShutdownTimeout, err = getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if config.BlobTimeout, err = getEnvDuration("LINE_BLOB_TIMEOUT", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if config.BlobHeaderTimeout, err = getEnvDuration("LINE_BLOB_HEADER_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if config.BlobMaxIdleConns, err = getEnvInt("LINE_BLOB_MAX_IDLE_CONNS", 10); err != nil {
+		return nil, err
+	}
+	if config.TranscodeWait, err = getEnvDuration("LINE_TRANSCODE_WAIT", time.Minute); err != nil {
+		return nil, err
+	}
+	externalMaxMB, err := getEnvInt("EXTERNAL_CONTENT_MAX_MB", 200)
 	if err != nil {
 		return nil, err
 	}
-	return &realBlobAPI{api: api}, nil
+	if externalMaxMB <= 0 {
+		return nil, fmt.Errorf("invalid EXTERNAL_CONTENT_MAX_MB: must be positive")
+	}
+	config.ExternalMaxSize = int64(externalMaxMB) << 20
+	if config.ThumbnailSize, err = getEnvInt("THUMBNAIL_SIZE", 320); err != nil {
+		return nil, err
+	}
+	if config.ThumbnailSize <= 0 {
+		return nil, fmt.Errorf("invalid THUMBNAIL_SIZE: must be positive")
+	}
+
+	// Load admin users from env var (comma-separated list)
+	adminUsersStr := os.Getenv("ADMIN_USERS")
+	if adminUsersStr != "" {
+		config.AdminUsers = strings.Split(adminUsersStr, ",")
+	}
+
+	return config, nil
 }
 
 func main() {
@@ -323,6 +513,12 @@ func main() {
 		log.Fatal("Error initializing bot:", err)
 	}
 
+	// Initialize the LINE content client shared by all downloads
+	blob, err := newBlobAPI(config)
+	if err != nil {
+		log.Fatal("Error initializing blob client:", err)
+	}
+
 	// Initialize Google Drive client
 	driveService, err := initializeDriveClient(config)
 	if err != nil {
@@ -330,17 +526,59 @@ func main() {
 	}
 	log.Println("Successfully initialized Google Drive client")
 
+	// Load per-group settings
+	settings, err := loadSettings(config.GroupSettingsFile)
+	if err != nil {
+		log.Fatal("Failed to load group settings:", err)
+	}
+
 	// Initialize message cache
 	messageCache := NewMessageCache()
+	if err := messageCache.Load(filepath.Join(config.StateDir, messageCacheFile)); err != nil {
+		log.Printf("Error loading message cache: %v", err)
+	}
 
 	// Initialize group cache
 	groupCache := NewGroupCache()
+	if err := groupCache.Load(filepath.Join(config.StateDir, groupCacheFile)); err != nil {
+		log.Printf("Error loading group cache: %v", err)
+	}
+
+	// Track in-flight uploads so shutdown can drain them
+	tracker := NewUploadTracker()
+
+	pipeline := &Pipeline{
+		bot:           NewRetryingSender(bot),
+		blob:          blob,
+		external:      newExternalContentClient(config, false),
+		profiles:      bot,
+		names:         NewNameCache(),
+		drive:         driveService,
+		messageCache:  messageCache,
+		groupCache:    groupCache,
+		tracker:       tracker,
+		folders:       NewFolderCache(),
+		settings:      settings,
+		contactSheets: NewContactSheets(filepath.Join(config.StateDir, contactSheetsDir)),
+		transcripts:   NewTranscripts(filepath.Join(config.StateDir, transcriptsDir)),
+		places:        NewPlaces(filepath.Join(config.StateDir, placesDir)),
+		config:        config,
+	}
+	if config.ClamAVAddress != "" {
+		if pipeline.scanner, err = newClamAVScanner(config.ClamAVAddress); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Downloads are cancelled if they outlive the shutdown grace period
+	uploadCtx, cancelUploads := context.WithCancel(context.Background())
+	defer cancelUploads()
 
 	// Create main router
 	router := http.NewServeMux()
 
 	// Add callback handler with group cache
-	router.HandleFunc("/callback", callbackHandler(bot, driveService, messageCache, groupCache, config))
+	router.HandleFunc("/callback", callbackHandler(uploadCtx, pipeline))
 
 	// Add health check endpoint
 	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -364,14 +602,71 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
-	log.Printf("Server is running at :%s", config.Port)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	// Retry uploads that were still pending when the previous run stopped
+	pipeline.requeuePendingUploads(uploadCtx)
+
+	// Turn each finished day's thumbnails into contact sheets
+	go pipeline.runContactSheets(uploadCtx)
+	transcriptsDone := make(chan struct{})
+	go func() {
+		pipeline.runTranscripts(uploadCtx)
+		close(transcriptsDone)
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("Server is running at :%s", config.Port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Printf("Shutting down, waiting up to %v for in-flight uploads...", config.ShutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+
+	pending := tracker.Drain(shutdownCtx)
+	cancelUploads()
+	if len(pending) > 0 {
+		log.Printf("%d uploads did not finish, saving them for the next start", len(pending))
+	}
+	if err := savePendingUploads(filepath.Join(config.StateDir, pendingUploadsFile), pending); err != nil {
+		log.Printf("Error saving pending uploads: %v", err)
+	}
+
+	// Let the last transcript sync finish, within the same deadline
+	select {
+	case <-transcriptsDone:
+	case <-shutdownCtx.Done():
+		log.Printf("Transcripts were not synced in time, they are uploaded after the restart")
 	}
+
+	// Flush caches to disk
+	if err := messageCache.Save(filepath.Join(config.StateDir, messageCacheFile)); err != nil {
+		log.Printf("Error saving message cache: %v", err)
+	}
+	if err := groupCache.Save(filepath.Join(config.StateDir, groupCacheFile)); err != nil {
+		log.Printf("Error saving group cache: %v", err)
+	}
+	log.Println("Shutdown complete")
 }
 
+// MessageSender sends messages to LINE. Replies need a reply token, which
+// can be used once and expires shortly after the event; push and multicast
+// reach a chat or users at any time.
 type MessageSender interface {
 	ReplyMessage(request *messaging_api.ReplyMessageRequest) (*messaging_api.ReplyMessageResponse, error)
+	PushMessage(request *messaging_api.PushMessageRequest, xLineRetryKey string) (*messaging_api.PushMessageResponse, error)
+	Multicast(request *messaging_api.MulticastRequest, xLineRetryKey string) (*map[string]interface{}, error)
 }
 
 func sendMessage(bot MessageSender, replyToken, text string) {
@@ -395,20 +690,41 @@ func sendMessage(bot MessageSender, replyToken, text string) {
 	}
 }
 
-func getOrCreateGroupFolder(driveService DriveService, groupID, parentFolderID string) string {
-	folderName := fmt.Sprintf("LINE-Group-%s", groupID)
-	folder := &drive.File{
-		Name:     folderName,
-		Parents:  []string{parentFolderID},
-		MimeType: "application/vnd.google-apps.folder",
+func groupFolderName(groupID string) string {
+	if isRoomID(groupID) {
+		return fmt.Sprintf("LINE-Room-%s", groupID)
 	}
+	return fmt.Sprintf("LINE-Group-%s", groupID)
+}
+
+// isRoomID tells multi-person chats (rooms) from groups, which share the
+// group ID slot everywhere else. LINE room IDs start with "R", group IDs
+// with "C".
+func isRoomID(groupID string) bool {
+	return strings.HasPrefix(groupID, "R")
+}
+
+// userFolderName names the folder of a user's direct messages
+func userFolderName(userID string) string {
+	return fmt.Sprintf("LINE-User-%s", userID)
+}
 
-	createdFolder, err := driveService.Files().CreateFile(folder, nil)
+// imageSetFolderName names the subfolder shared by photos sent together.
+// Set IDs are long hex strings; a prefix is enough to tell sets apart.
+func imageSetFolderName(setID string) string {
+	if len(setID) > 12 {
+		setID = setID[:12]
+	}
+	return fmt.Sprintf("ImageSet-%s", setID)
+}
+
+func getOrCreateGroupFolder(driveService DriveService, groupID, parentFolderID string) string {
+	folderID, err := getOrCreateFolder(driveService, groupFolderName(groupID), parentFolderID)
 	if err != nil {
 		log.Printf("Error creating group folder: %v", err)
 		return parentFolderID
 	}
-	return createdFolder.Id
+	return folderID
 }
 
 func getFileExtension(message webhook.MessageContentInterface) string {
@@ -426,9 +742,10 @@ func getFileExtension(message webhook.MessageContentInterface) string {
 	}
 }
 
-func handleFileMessage(bot *messaging_api.MessagingApiAPI, driveService DriveService,
-	message webhook.MessageContentInterface, fileExt string, replyToken string,
-	messageCache *MessageCache, folderID string, config *Config) error {
+// handleFileMessage archives a media message unless it was archived before,
+// in which case it returns a nil result.
+func (p *Pipeline) handleFileMessage(ctx context.Context, message webhook.MessageContentInterface,
+	fileExt string, replyToken string, folderID string, settings GroupSettings, names chatNames) (*uploadResult, error) {
 	// Get messageID based on message type
 	var messageID string
 	switch m := message.(type) {
@@ -442,23 +759,24 @@ func handleFileMessage(bot *messaging_api.MessagingApiAPI, driveService DriveSer
 		messageID = m.Id
 	default:
 		log.Printf("Unsupported message type: %T", message)
-		return fmt.Errorf("unsupported message type: %T", message)
+		return nil, fmt.Errorf("unsupported message type: %T", message)
 	}
 
 	// Check if we've already processed this message
-	if messageCache.IsProcessed(messageID) {
+	if p.messageCache.IsProcessed(messageID) {
 		log.Printf("Skipping already processed message ID: %s", messageID)
-		return nil
+		return nil, nil
 	}
 
 	log.Printf("File message received (Message ID: %s)", messageID)
-	if err := handleFile(bot, driveService, message, messageID, fileExt, replyToken, config); err != nil {
+	result, err := p.handleFile(ctx, message, messageID, fileExt, replyToken, folderID, settings, names)
+	if err != nil {
 		log.Printf("Error handling file: %v", err)
-		return err
+		return nil, err
 	}
 	// Mark as processed after successful handling
-	messageCache.MarkProcessed(messageID)
-	return nil
+	p.messageCache.MarkProcessed(messageID)
+	return result, nil
 }
 
 type DriveService interface {
@@ -467,6 +785,9 @@ type DriveService interface {
 
 type FilesService interface {
 	CreateFile(file *drive.File, media io.Reader) (*drive.File, error)
+	UpdateFile(fileID string, file *drive.File, media io.Reader) (*drive.File, error)
+	MoveFile(fileID, addParents, removeParents string) (*drive.File, error)
+	ListFiles(query string) ([]*drive.File, error)
 }
 
 // Wrapper for the real Drive service
@@ -483,74 +804,235 @@ type filesServiceWrapper struct {
 }
 
 func (f *filesServiceWrapper) CreateFile(file *drive.File, media io.Reader) (*drive.File, error) {
-	call := f.FilesService.Create(file)
+	call := f.FilesService.Create(file).Fields("id", "name", "mimeType", "size", "sha256Checksum")
 	if media != nil {
 		call.Media(media)
 	}
 	return call.Do()
 }
 
+func (f *filesServiceWrapper) UpdateFile(fileID string, file *drive.File, media io.Reader) (*drive.File, error) {
+	call := f.FilesService.Update(fileID, file).Fields("id", "name", "mimeType", "size", "sha256Checksum")
+	if media != nil {
+		call.Media(media)
+	}
+	return call.Do()
+}
+
+// MoveFile changes the parents of a file; both lists are comma-separated IDs
+func (f *filesServiceWrapper) MoveFile(fileID, addParents, removeParents string) (*drive.File, error) {
+	return f.FilesService.Update(fileID, &drive.File{}).
+		AddParents(addParents).RemoveParents(removeParents).
+		Fields("id", "name", "parents").Do()
+}
+
+func (f *filesServiceWrapper) ListFiles(query string) ([]*drive.File, error) {
+	list, err := f.FilesService.List().Q(query).
+		Fields("files(id, name, mimeType, parents, appProperties)").
+		PageSize(100).Do()
+	if err != nil {
+		return nil, err
+	}
+	return list.Files, nil
+}
+
+// uploadResult describes a file stored by handleFile
+type uploadResult struct {
+	File     *drive.File
+	FolderID string // folder the file was stored in, after date sorting
+	MimeType string
+	Content  []byte // copy of the photo when a thumbnail was requested
+	Threat   string // malware found by the virus scan; the file is in quarantine
+}
+
 // Update handleFile to use the variable
-func handleFile(bot *messaging_api.MessagingApiAPI, driveService DriveService,
-	message webhook.MessageContentInterface, messageID string, fileExt string, replyToken string, config *Config) error {
+func (p *Pipeline) handleFile(ctx context.Context, message webhook.MessageContentInterface,
+	messageID string, fileExt string, replyToken string, folderID string, settings GroupSettings,
+	names chatNames) (*uploadResult, error) {
 	log.Printf("Processing file message ID: %s", messageID)
 
 	// Get the file content from LINE
-	blob, err := NewBlobAPI(config.LineChannelToken)
+	content, err := p.openContent(ctx, message, messageID)
 	if err != nil {
-		return fmt.Errorf("failed to create blob client: %v", err)
+		return nil, fmt.Errorf("failed to get content: %w", err)
 	}
+	defer content.Close()
 
-	content, err := blob.GetMessageContent(messageID)
-	if err != nil {
-		return fmt.Errorf("failed to get content: %v", err)
+	// Peek at the leading bytes to find the real type and capture date
+	// without consuming them
+	buffered := bufio.NewReaderSize(content, metadataPeekLen)
+	header, _ := buffered.Peek(metadataPeekLen)
+	mimeType, detectedExt := detectMessageContentType(message, header, content.ContentType)
+	if _, isFile := message.(webhook.FileMessageContent); !isFile {
+		fileExt = detectedExt
 	}
-	defer content.Close()
+	log.Printf("Detected content type: %s", mimeType)
 
-	// Create a temporary file with timestamp
-	timestamp := time.Now().Format("20060102-150405")
-	tmpFile, err := os.CreateTemp("", fmt.Sprintf("line-file-%s-*%s", timestamp, fileExt))
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %v", err)
+	// Now that the real type and size are known, check the chat's rules again
+	if err := settings.checkMedia(messageType(message), fileExt, content.ContentLength, mimeType); err != nil {
+		return nil, err
 	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
 
-	// Copy the file content and track size
-	written, err := io.Copy(tmpFile, content)
-	if err != nil {
-		return fmt.Errorf("failed to copy content: %v", err)
+	// Prefer when the photo or video was taken over when it was shared
+	fileTime := time.Now()
+	captureTime, hasCaptureTime := extractCaptureTime(header, mimeType)
+	if hasCaptureTime {
+		log.Printf("Capture time: %s", captureTime.Format(time.RFC3339))
+		fileTime = captureTime
+	}
+
+	// Sort into date-based folders when configured
+	if p.config.DateFolderFormat != "" {
+		folderID, err = p.folderPath(fileTime.Format(p.config.DateFolderFormat), folderID)
+		if err != nil {
+			return nil, err
+		}
 	}
-	log.Printf("File size: %.2f MB", float64(written)/(1024*1024))
 
-	// Get original filename for file messages
-	fileName := filepath.Base(tmpFile.Name())
-	if fileMsg, ok := message.(webhook.FileMessageContent); ok {
+	// Name media after the capture or upload time, keep the original name for files
+	timestamp := fileTime.Format("20060102-150405")
+	fileName := fmt.Sprintf("line-file-%s-%s%s", timestamp, messageID, fileExt)
+	fileMsg, isFile := message.(webhook.FileMessageContent)
+	if isFile {
 		fileName = fileMsg.FileName
 	}
+	if p.config.FileNameTemplate != "" {
+		fileName = renderFileName(p.config.FileNameTemplate, fileNameFields{
+			Time:      fileTime,
+			MessageID: messageID,
+			Type:      messageType(message),
+			FileName:  fileMsg.FileName,
+			Names:     names,
+		}, fileExt)
+	}
+
+	// Keep photos that were sent together in one folder, in the order they were sent
+	if image, ok := message.(webhook.ImageMessageContent); ok && image.ImageSet != nil {
+		folderID, err = p.folder(imageSetFolderName(image.ImageSet.Id), folderID)
+		if err != nil {
+			return nil, err
+		}
+		if image.ImageSet.Index > 0 {
+			fileName = fmt.Sprintf("%02d-%s", image.ImageSet.Index, fileName)
+		}
+	}
+
+	// Names come from users; make them safe and decide what to do about clashes
+	fileName, existing, err := p.resolveCollision(folderID, sanitizeFileName(fileName), messageID)
+	if err != nil {
+		return nil, err
+	}
 
 	// Upload to Google Drive
 	driveFile := &drive.File{
 		Name:    fileName,
-		Parents: []string{config.GoogleDriveFolderID},
+		Parents: []string{folderID},
+		// Lets the file be found again when the message is unsent
+		AppProperties: map[string]string{
+			lineMessageIDProperty: messageID,
+		},
+	}
+	// Let Drive work it out when the content is unrecognizable
+	if mimeType != "application/octet-stream" {
+		driveFile.MimeType = mimeType
+	}
+	if hasCaptureTime {
+		driveFile.CreatedTime = captureTime.Format(time.RFC3339)
+		driveFile.AppProperties["captureTime"] = captureTime.Format(time.RFC3339)
 	}
 
-	file, err := os.Open(tmpFile.Name())
-	if err != nil {
-		return fmt.Errorf("failed to open temp file: %v", err)
+	// Remove location and personal details for groups that asked for it
+	var source io.Reader = buffered
+	if settings.Privacy && supportsMetadataStripping(mimeType) {
+		log.Println("Privacy mode: stripping location and personal metadata")
+		stripped := stripPrivateMetadata(buffered, mimeType)
+		defer stripped.Close()
+		source = stripped
+	}
+
+	// Keep a copy of photos that get a thumbnail once they are stored
+	var capture *captureBuffer
+	if settings.Thumbnails && supportsThumbnails(mimeType) {
+		capture = newCaptureBuffer(maxThumbnailSource)
+		source = io.TeeReader(source, capture)
+	}
+
+	// Stream the content straight into the upload, hashing it on the way
+	stream := newUploadStream(source)
+	var media io.Reader = stream
+
+	files := p.drive.Files()
+	var threat string
+	switch {
+	case p.scanner != nil:
+		// Hold the upload back until clamd has seen all of it
+		spooled, found, err := p.scanToTempFile(ctx, stream, fmt.Sprintf("line-file-%s-*%s", timestamp, fileExt))
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+		media, threat = spooled, found
+	case needsSeekableMedia(files):
+		spooled, err := spoolToTempFile(stream, fmt.Sprintf("line-file-%s-*%s", timestamp, fileExt))
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+		media = spooled
 	}
-	defer file.Close()
 
-	log.Println("Uploading file to Google Drive...")
-	uploadedFile, err := driveService.Files().CreateFile(driveFile, file)
+	// Infected files never end up next to the chat's media
+	if threat != "" {
+		folderID = p.config.QuarantineFolderID
+		driveFile.Parents = []string{folderID}
+		driveFile.AppProperties["threat"] = threat
+		existing, capture = nil, nil
+	}
+
+	var uploadedFile *drive.File
+	if p.config.FileCollision == collisionVersion && len(existing) > 0 {
+		log.Printf("Uploading new version of %s to Google Drive...", fileName)
+		update := &drive.File{MimeType: driveFile.MimeType, AppProperties: driveFile.AppProperties}
+		uploadedFile, err = files.UpdateFile(existing[0].Id, update, media)
+	} else {
+		log.Println("Uploading file to Google Drive...")
+		uploadedFile, err = files.CreateFile(driveFile, media)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to upload to Drive: %v", err)
+		return nil, fmt.Errorf("failed to upload to Drive: %v", err)
+	}
+	log.Printf("File size: %.2f MB, SHA-256: %s", float64(stream.Size())/(1024*1024), stream.Sum())
+
+	// Verify what the backend stored when it reports it
+	if uploadedFile.Size != 0 && uploadedFile.Size != stream.Size() {
+		return nil, fmt.Errorf("uploaded size mismatch: sent %d bytes, stored %d", stream.Size(), uploadedFile.Size)
+	}
+	if uploadedFile.Sha256Checksum != "" && uploadedFile.Sha256Checksum != stream.Sum() {
+		return nil, fmt.Errorf("uploaded checksum mismatch for file %s", uploadedFile.Id)
 	}
 	log.Printf("File uploaded successfully to Drive with ID: %s", uploadedFile.Id)
 
-	// Remove the reply message code
-	// The function should just return nil after successful upload
-	return nil
+	// Only trash what is being replaced once the replacement is stored
+	if p.config.FileCollision == collisionOverwrite {
+		for _, old := range existing {
+			if _, err := files.UpdateFile(old.Id, &drive.File{Trashed: true}, nil); err != nil {
+				log.Printf("Error trashing overwritten file %s: %v", old.Id, err)
+			}
+		}
+	}
+
+	result := &uploadResult{
+		File:     uploadedFile,
+		FolderID: folderID,
+		MimeType: mimeType,
+		Threat:   threat,
+	}
+	if capture != nil {
+		result.Content = capture.Bytes()
+	}
+	return result, nil
 }
 
 // Update the initialization function
@@ -565,6 +1047,11 @@ func initializeDriveClient(config *Config) (DriveService, error) {
 	return &driveServiceWrapper{service}, nil
 }
 
+// isAdmin reports whether userID is listed in ADMIN_USERS
+func isAdmin(userID string, config *Config) bool {
+	return userID != "" && slices.Contains(config.AdminUsers, userID)
+}
+
 func isAllowedUser(userID string, config *Config) bool {
 	for _, adminID := range config.AdminUsers {
 		if userID == adminID {
@@ -574,13 +1061,49 @@ func isAllowedUser(userID string, config *Config) bool {
 	return true // Allow all users by default
 }
 
+// getSourceIDs extracts the sender and group IDs from an event source. Rooms
+// are chats of their own, so their ID is returned as the group ID. The SDK
+// decodes sources as values, but pointers are accepted as well.
+func getSourceIDs(source webhook.SourceInterface) (userID, groupID string) {
+	switch s := source.(type) {
+	case webhook.UserSource:
+		return s.UserId, ""
+	case *webhook.UserSource:
+		return s.UserId, ""
+	case webhook.GroupSource:
+		return s.UserId, s.GroupId
+	case *webhook.GroupSource:
+		return s.UserId, s.GroupId
+	case webhook.RoomSource:
+		return s.UserId, s.RoomId
+	case *webhook.RoomSource:
+		return s.UserId, s.RoomId
+	}
+	return "", ""
+}
+
+// uploadJobsFromEvents collects the media messages of a webhook delivery
+func uploadJobsFromEvents(events []webhook.EventInterface) []UploadJob {
+	var jobs []UploadJob
+	for _, event := range events {
+		e, ok := event.(webhook.MessageEvent)
+		if !ok {
+			continue
+		}
+		userID, groupID := getSourceIDs(e.Source)
+		if job, ok := newUploadJob(e.Message, userID, groupID); ok {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
 // Add the callbackHandler function
-func callbackHandler(bot *messaging_api.MessagingApiAPI, driveService DriveService,
-	messageCache *MessageCache, groupCache *GroupCache, config *Config) http.HandlerFunc {
+func callbackHandler(ctx context.Context, p *Pipeline) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		log.Printf("Received %s request to %s", req.Method, req.URL.Path)
 
-		cb, err := webhook.ParseRequest(config.LineChannelSecret, req)
+		cb, err := webhook.ParseRequest(p.config.LineChannelSecret, req)
 		if err != nil {
 			if err == webhook.ErrInvalidSignature {
 				log.Printf("Invalid signature error: %v", err)
@@ -592,69 +1115,81 @@ func callbackHandler(bot *messaging_api.MessagingApiAPI, driveService DriveServi
 			return
 		}
 
+		// Refuse new work while shutting down so LINE can redeliver it
+		jobs := uploadJobsFromEvents(cb.Events)
+		if !p.tracker.Accept(jobs) {
+			log.Printf("Rejecting webhook during shutdown")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
 		// Send 200 OK immediately after validation
 		w.WriteHeader(http.StatusOK)
 
 		// Process events asynchronously
 		go func() {
+			defer p.tracker.Done(jobs)
+
+			// Uploads are confirmed in one reply per chat once all events are handled
+			receipts := NewReceipts()
+			defer p.sendReceipts(receipts)
+
 			for _, event := range cb.Events {
 				switch e := event.(type) {
 				case webhook.MessageEvent:
 					// Get user ID and group ID if applicable
-					var userID, groupID string
-					switch source := e.Source.(type) {
-					case *webhook.UserSource:
-						userID = source.UserId
-					case *webhook.GroupSource:
-						userID = source.UserId
-						groupID = source.GroupId
-					case *webhook.RoomSource:
-						userID = source.UserId
-					}
+					userID, groupID := getSourceIDs(e.Source)
 
-					if !isAllowedUser(userID, config) {
-						sendMessage(bot, e.ReplyToken, "Sorry, you don't have permission to use this bot.")
+					if !isAllowedUser(userID, p.config) {
+						sendMessage(p.bot, e.ReplyToken, tr(p.chatLocale(userID, groupID), msgNotAllowed))
 						continue
 					}
 
 					switch message := e.Message.(type) {
 					case webhook.TextMessageContent:
 						// Handle commands for both group and direct messages
-						if strings.HasPrefix(message.Text, "/") {
-							handleCommand(bot, message.Text, groupID, e.ReplyToken, groupCache)
+						if command, ok := commandText(message); ok {
+							handleCommand(p.bot, command, userID, groupID, e.ReplyToken, p.groupCache, p.chatLocale(userID, groupID), isAdmin(userID, p.config))
 							continue
 						}
-						// Ignore non-command text messages
+						p.recordText(message.Id, message.Text, userID, groupID, time.UnixMilli(e.Timestamp))
+
+					case webhook.LocationMessageContent:
+						p.recordLocation(message, userID, groupID, time.UnixMilli(e.Timestamp))
 
 					case webhook.ImageMessageContent, webhook.FileMessageContent,
 						webhook.VideoMessageContent, webhook.AudioMessageContent:
-						// Create group-specific folder structure if needed
-						folderID := config.GoogleDriveFolderID
-						if groupID != "" {
-							folderID = getOrCreateGroupFolder(driveService, groupID, config.GoogleDriveFolderID)
+						job, _ := newUploadJob(e.Message, userID, groupID)
+						if !p.admitUpload(job, e.ReplyToken, receipts) {
+							p.tracker.Finish(job.MessageID)
+							continue
 						}
+						p.runUpload(ctx, job, e.ReplyToken, receipts)
+					}
 
-						// Get filename for tracking
-						var fileName string
-						if fileMsg, ok := message.(webhook.FileMessageContent); ok {
-							fileName = fileMsg.FileName
-						} else {
-							fileName = fmt.Sprintf("file%s", getFileExtension(e.Message))
-						}
+				case webhook.FollowEvent:
+					userID, _ := getSourceIDs(e.Source)
+					p.handleFollow(userID, e.ReplyToken)
 
-						// Handle the file upload
-						if err := handleFileMessage(bot, driveService, e.Message, getFileExtension(e.Message),
-							e.ReplyToken, messageCache, folderID, config); err != nil {
-							log.Printf("Error handling file: %v", err)
-							continue
-						}
+				case webhook.UnfollowEvent:
+					userID, _ := getSourceIDs(e.Source)
+					p.handleUnfollow(userID)
 
-						// Track all uploads, using "direct" as groupID for direct messages
-						trackingGroupID := groupID
-						if trackingGroupID == "" {
-							trackingGroupID = "direct"
-						}
-						groupCache.AddUploadedFile(trackingGroupID, fileName)
+				case webhook.JoinEvent:
+					_, groupID := getSourceIDs(e.Source)
+					p.handleJoin(groupID, e.ReplyToken)
+
+				case webhook.LeaveEvent:
+					_, groupID := getSourceIDs(e.Source)
+					p.handleLeave(groupID)
+
+				case webhook.UnsendEvent:
+					if e.Unsend == nil {
+						continue
+					}
+					_, groupID := getSourceIDs(e.Source)
+					if err := p.handleUnsend(e.Unsend.MessageId, groupID); err != nil {
+						log.Printf("Error handling unsend of %s: %v", e.Unsend.MessageId, err)
 					}
 				}
 			}
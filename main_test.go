@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -97,7 +98,7 @@ func TestGroupCache(t *testing.T) {
 	}
 
 	// Test increment
-	cache.AddUploadedFile(groupID, "test.jpg")
+	cache.AddUploadedFile(groupID, "test.jpg", "")
 	uploads, lastUpload, files = cache.GetStats(groupID)
 	if uploads != 1 {
 		t.Errorf("Uploads after increment = %d, want 1", uploads)
@@ -110,7 +111,7 @@ func TestGroupCache(t *testing.T) {
 	}
 
 	// Test multiple files
-	cache.AddUploadedFile(groupID, "test2.jpg")
+	cache.AddUploadedFile(groupID, "test2.jpg", "")
 	uploads, _, files = cache.GetStats(groupID)
 	if uploads != 2 {
 		t.Errorf("Uploads after second increment = %d, want 2", uploads)
@@ -121,7 +122,7 @@ func TestGroupCache(t *testing.T) {
 
 	// Test file limit (should keep only last 5)
 	for i := 0; i < 5; i++ {
-		cache.AddUploadedFile(groupID, fmt.Sprintf("test%d.jpg", i+3))
+		cache.AddUploadedFile(groupID, fmt.Sprintf("test%d.jpg", i+3), "")
 	}
 	_, _, files = cache.GetStats(groupID)
 	if len(files) != 5 {
@@ -199,6 +200,7 @@ func TestHandleCommand(t *testing.T) {
 		name      string
 		text      string
 		groupID   string
+		admin     bool
 		wantText  string
 		checkFunc func(string) bool
 	}{
@@ -209,8 +211,8 @@ func TestHandleCommand(t *testing.T) {
 This bot automatically saves photos and files shared in this chat to Google Drive for easy access and backup.
 
 Available commands:
-/help - Show this help message
-/stats - Show last 5 uploads and statistics
+/help [command] - Show this help message
+/stats [period] - Show last 5 uploads and statistics
 /upload - Show upload instructions`,
 		},
 		{
@@ -225,8 +227,9 @@ Available commands:
 			},
 		},
 		{
-			name: "Stats command in direct message",
-			text: "/stats",
+			name:  "Stats command in direct message",
+			text:  "/stats",
+			admin: true,
 			checkFunc: func(msg string) bool {
 				return strings.Contains(msg, "📊 Upload Statistics") &&
 					strings.Contains(msg, "Total uploads: 2") &&
@@ -244,8 +247,8 @@ Available commands:
 3. Files are organized by group/chat
 
 Supported file types:
-• Photos (JPG)
-• Videos (MP4)
+• Photos (JPG, PNG, GIF, HEIC)
+• Videos (MP4, MOV)
 • Audio files (M4A)
 • Documents (PDF, etc.)`,
 		},
@@ -269,11 +272,11 @@ Supported file types:
 
 			// Add test data only if needed for stats commands
 			if strings.Contains(tt.name, "Stats command") {
-				groupCache.AddUploadedFile("test-group", "test1.jpg")
-				groupCache.AddUploadedFile("test-group", "test2.jpg")
+				groupCache.AddUploadedFile("test-group", "test1.jpg", "")
+				groupCache.AddUploadedFile("test-group", "test2.jpg", "")
 			}
 
-			handleCommand(bot, tt.text, tt.groupID, "test-reply-token", groupCache)
+			handleCommand(bot, tt.text, "", tt.groupID, "test-reply-token", groupCache, localeEnglish, tt.admin)
 
 			// For non-command messages, verify no message was sent
 			if tt.text != "" && !strings.HasPrefix(tt.text, "/") {
@@ -383,18 +386,43 @@ func TestGetFileExtension(t *testing.T) {
 
 // Mock implementations
 type mockBot struct {
-	sentMessages []string
+	sentMessages []string // texts, and the alt text of Flex Messages
+	flex         []*messaging_api.FlexMessage
+	pushed       []string // "to: text"
+	multicast    []string // "to1,to2: text"
 }
 
 func (m *mockBot) ReplyMessage(request *messaging_api.ReplyMessageRequest) (*messaging_api.ReplyMessageResponse, error) {
 	for _, msg := range request.Messages {
-		if textMsg, ok := msg.(*messaging_api.TextMessage); ok {
-			m.sentMessages = append(m.sentMessages, textMsg.Text)
+		switch msg := msg.(type) {
+		case *messaging_api.TextMessage:
+			m.sentMessages = append(m.sentMessages, msg.Text)
+		case *messaging_api.FlexMessage:
+			m.sentMessages = append(m.sentMessages, msg.AltText)
+			m.flex = append(m.flex, msg)
 		}
 	}
 	return &messaging_api.ReplyMessageResponse{}, nil
 }
 
+func (m *mockBot) PushMessage(request *messaging_api.PushMessageRequest, _ string) (*messaging_api.PushMessageResponse, error) {
+	for _, msg := range request.Messages {
+		if textMsg, ok := msg.(*messaging_api.TextMessage); ok {
+			m.pushed = append(m.pushed, request.To+": "+textMsg.Text)
+		}
+	}
+	return &messaging_api.PushMessageResponse{}, nil
+}
+
+func (m *mockBot) Multicast(request *messaging_api.MulticastRequest, _ string) (*map[string]interface{}, error) {
+	for _, msg := range request.Messages {
+		if textMsg, ok := msg.(*messaging_api.TextMessage); ok {
+			m.multicast = append(m.multicast, strings.Join(request.To, ",")+": "+textMsg.Text)
+		}
+	}
+	return &map[string]interface{}{}, nil
+}
+
 func newMockBot() *mockBot {
 	return &mockBot{
 		sentMessages: make([]string, 0),
@@ -417,16 +445,64 @@ func (m *mockDriveService) Files() FilesService {
 }
 
 // Mock FilesService
-type mockFilesService struct{}
+type mockFilesService struct {
+	created  []*drive.File
+	uploaded [][]byte
+	updated  []string // IDs passed to UpdateFile
+	trashed  []string // IDs moved to the trash with UpdateFile
+	moved    []string // "fileID -> new parents" passed to MoveFile
+	queries  []string
+	existing []*drive.File // returned by ListFiles when the query matches their name or LINE message ID
+}
 
 // In the test, we directly return a dummy drive.File:
 func (m *mockFilesService) CreateFile(file *drive.File, media io.Reader) (*drive.File, error) {
+	if media != nil {
+		data, err := io.ReadAll(media)
+		if err != nil {
+			return nil, err
+		}
+		m.uploaded = append(m.uploaded, data)
+	}
+	m.created = append(m.created, file)
 	return &drive.File{
 		Id:   "mock-file-id",
 		Name: file.Name,
 	}, nil
 }
 
+func (m *mockFilesService) UpdateFile(fileID string, file *drive.File, media io.Reader) (*drive.File, error) {
+	if media != nil {
+		data, err := io.ReadAll(media)
+		if err != nil {
+			return nil, err
+		}
+		m.uploaded = append(m.uploaded, data)
+	}
+	m.updated = append(m.updated, fileID)
+	if file.Trashed {
+		m.trashed = append(m.trashed, fileID)
+	}
+	return &drive.File{Id: fileID, Name: file.Name}, nil
+}
+
+func (m *mockFilesService) MoveFile(fileID, addParents, removeParents string) (*drive.File, error) {
+	m.moved = append(m.moved, fileID+" -> "+addParents)
+	return &drive.File{Id: fileID, Parents: []string{addParents}}, nil
+}
+
+func (m *mockFilesService) ListFiles(query string) ([]*drive.File, error) {
+	m.queries = append(m.queries, query)
+	var matches []*drive.File
+	for _, f := range m.existing {
+		if strings.Contains(query, fmt.Sprintf("name = '%s'", escapeQueryValue(f.Name))) ||
+			strings.Contains(query, fmt.Sprintf("value='%s'", escapeQueryValue(f.AppProperties[lineMessageIDProperty]))) {
+			matches = append(matches, f)
+		}
+	}
+	return matches, nil
+}
+
 // Add a helper function to create test config
 func newTestConfig() *Config {
 	return &Config{
@@ -440,26 +516,46 @@ func newTestConfig() *Config {
 
 // Update mockBlobAPI to match the interface
 type mockBlobAPI struct {
-	content []byte
+	content  []byte
+	statuses []string // transcoding statuses returned in turn, the last one repeats
+	polls    int
 }
 
-func (m *mockBlobAPI) GetMessageContent(messageID string) (io.ReadCloser, error) {
-	return io.NopCloser(bytes.NewReader(m.content)), nil
+func (m *mockBlobAPI) GetMessageContent(ctx context.Context, messageID string) (*BlobContent, error) {
+	return &BlobContent{
+		ReadCloser:    io.NopCloser(bytes.NewReader(m.content)),
+		ContentLength: int64(len(m.content)),
+	}, nil
+}
+
+func (m *mockBlobAPI) GetTranscodingStatus(ctx context.Context, messageID string) (string, error) {
+	m.polls++
+	if len(m.statuses) == 0 {
+		return "succeeded", nil
+	}
+	return m.statuses[min(m.polls, len(m.statuses))-1], nil
+}
+
+// newTestPipeline wires the given mocks into a pipeline with fresh caches
+func newTestPipeline(blob BlobAPI, driveService DriveService, config *Config) *Pipeline {
+	return &Pipeline{
+		bot:          newMockBot(),
+		blob:         blob,
+		drive:        driveService,
+		messageCache: NewMessageCache(),
+		groupCache:   NewGroupCache(),
+		tracker:      NewUploadTracker(),
+		folders:      NewFolderCache(),
+		names:        NewNameCache(),
+		settings:     NewSettings(),
+		config:       config,
+	}
 }
 
 func TestHandleFileMessage(t *testing.T) {
 	// Create some mock content
 	mockContent := []byte("fake file content")
 
-	// Save the original function so we can restore it
-	originalNewBlobAPI := NewBlobAPI
-	defer func() { NewBlobAPI = originalNewBlobAPI }()
-
-	// Override NewBlobAPI to return our mock
-	NewBlobAPI = func(channelToken string) (BlobAPI, error) {
-		return &mockBlobAPI{content: mockContent}, nil
-	}
-
 	tests := []struct {
 		name        string
 		message     webhook.MessageContentInterface
@@ -510,13 +606,12 @@ func TestHandleFileMessage(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Create mock dependencies
-			bot := &messaging_api.MessagingApiAPI{} // Use real type but mock the calls
-			driveService := newMockDriveService()
-			messageCache := NewMessageCache()
 			config := &Config{
 				LineChannelToken:    "mock-token",
 				GoogleDriveFolderID: "mock-folder",
 			}
+			pipeline := newTestPipeline(&mockBlobAPI{content: mockContent}, newMockDriveService(), config)
+			messageCache := pipeline.messageCache
 			replyToken := "test-reply-token"
 
 			// Create temporary test file
@@ -534,8 +629,8 @@ func TestHandleFileMessage(t *testing.T) {
 			}
 
 			// Call handleFileMessage
-			err = handleFileMessage(bot, driveService, tt.message, tt.fileExt, replyToken,
-				messageCache, config.GoogleDriveFolderID, config)
+			_, err = pipeline.handleFileMessage(context.Background(), tt.message, tt.fileExt, replyToken,
+				config.GoogleDriveFolderID, GroupSettings{}, chatNames{})
 
 			// Verify results
 			if tt.shouldError {
@@ -665,13 +760,13 @@ func TestStatsTracking(t *testing.T) {
 				if trackingGroupID == "" {
 					trackingGroupID = "direct"
 				}
-				groupCache.AddUploadedFile(trackingGroupID, upload.fileName)
+				groupCache.AddUploadedFile(trackingGroupID, upload.fileName, "")
 			}
 
 			// Check stats for each scenario
 			for _, check := range tt.checkStats {
-				// Call /stats command
-				handleCommand(bot, "/stats", check.groupID, "test-reply-token", groupCache)
+				// Call /stats command; only admins get the global stats
+				handleCommand(bot, "/stats", "", check.groupID, "test-reply-token", groupCache, localeEnglish, check.groupID == "")
 
 				// Get the last sent message
 				if len(bot.sentMessages) == 0 {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"path"
+	"strings"
+)
+
+// mediaNotAllowedError is returned for media a chat's rules exclude. The
+// reason is meant for the chat.
+type mediaNotAllowedError struct {
+	reason localized
+}
+
+func (e *mediaNotAllowedError) Error() string {
+	return "media not allowed: " + e.reason.text(localeEnglish)
+}
+
+// checkMedia applies the chat's media rules. Unknown values ("" or a size of
+// zero or less) are not checked, so it can run before the download with what
+// the webhook says and again once the content type is known.
+func (s GroupSettings) checkMedia(kind, ext string, size int64, mimeType string) error {
+	if len(s.AllowedTypes) > 0 && !containsFold(s.AllowedTypes, kind) {
+		return &mediaNotAllowedError{localize(msgTypeNotAllowed, uploadType(kind))}
+	}
+
+	ext = strings.ToLower(ext)
+	if len(s.AllowedFormats) > 0 && (ext != "" || mimeType != "") && !s.allowsFormat(ext, mimeType) {
+		format := ext
+		if format == "" {
+			format = mimeType
+		}
+		return &mediaNotAllowedError{localize(msgFormatNotAllowed, format)}
+	}
+
+	if s.MaxSizeMB > 0 && size > int64(s.MaxSizeMB)<<20 {
+		return &mediaNotAllowedError{localize(msgSizeOverLimit, float64(size)/(1<<20), s.MaxSizeMB)}
+	}
+	return nil
+}
+
+// allowsFormat matches an extension or MIME type against AllowedFormats,
+// which holds extensions (".pdf"), MIME types ("application/pdf") and
+// wildcards ("image/*").
+func (s GroupSettings) allowsFormat(ext, mimeType string) bool {
+	if mimeType == "" && ext != "" {
+		mimeType, _, _ = mime.ParseMediaType(mime.TypeByExtension(ext))
+	}
+
+	for _, format := range s.AllowedFormats {
+		format = strings.ToLower(format)
+		switch {
+		case strings.HasPrefix(format, "."):
+			if format == ext {
+				return true
+			}
+		case strings.HasSuffix(format, "/*"):
+			if mimeType != "" && strings.HasPrefix(mimeType, strings.TrimSuffix(format, "*")) {
+				return true
+			}
+		case format == mimeType:
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// admitUpload checks a job against its chat's media rules before anything is
+// downloaded, using the type, name and size given by the webhook.
+func (p *Pipeline) admitUpload(job UploadJob, replyToken string, receipts *Receipts) bool {
+	settings := p.settings.ForGroup(job.GroupID)
+	err := settings.checkMedia(job.Type, path.Ext(job.FileName), job.FileSize, "")
+	if err == nil {
+		return true
+	}
+	p.reportSkipped(job, settings, replyToken, receipts, err)
+	return false
+}
+
+// reportSkipped logs media excluded by a chat's rules and, if the chat asked
+// for it, tells the chat why.
+func (p *Pipeline) reportSkipped(job UploadJob, settings GroupSettings, replyToken string, receipts *Receipts, err error) {
+	log.Printf("Skipping %s: %v", job.MessageID, err)
+
+	var notAllowed *mediaNotAllowedError
+	if settings.NotifySkipped && errors.As(err, &notAllowed) {
+		var name interface{} = job.FileName
+		if job.FileName == "" {
+			name = localize(msgThisUpload, uploadType(job.Type))
+		}
+		receipts.Note(job, replyToken, localize(msgNoteSkipped, name, notAllowed.reason))
+	}
+}
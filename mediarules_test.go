@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCheckMedia(t *testing.T) {
+	settings := GroupSettings{
+		AllowedTypes:   []string{"image", "file"},
+		AllowedFormats: []string{"image/*", ".pdf"},
+		MaxSizeMB:      10,
+	}
+
+	tests := []struct {
+		name     string
+		kind     string
+		ext      string
+		size     int64
+		mimeType string
+		allowed  bool
+	}{
+		{"photo", "image", ".jpg", 1 << 20, "image/jpeg", true},
+		{"video kind", "video", ".mp4", 1 << 20, "", false},
+		{"pdf by extension", "file", ".pdf", 1 << 20, "", true},
+		{"apk", "file", ".apk", 1 << 20, "", false},
+		{"png by extension only", "file", ".PNG", 0, "", true},
+		{"too large", "image", ".jpg", 11 << 20, "", false},
+		{"unknown format and size", "image", "", 0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := settings.checkMedia(tt.kind, tt.ext, tt.size, tt.mimeType)
+			if (err == nil) != tt.allowed {
+				t.Errorf("checkMedia() error = %v, want allowed %v", err, tt.allowed)
+			}
+		})
+	}
+
+	if err := (GroupSettings{}).checkMedia("video", ".apk", 5<<30, ""); err != nil {
+		t.Errorf("default settings should allow everything, got %v", err)
+	}
+}
+
+func TestAdmitUploadNotifiesChat(t *testing.T) {
+	pipeline := newTestPipeline(&mockBlobAPI{}, newMockDriveService(), newTestConfig())
+	pipeline.settings.defaults = GroupSettings{MaxSizeMB: 1, NotifySkipped: true}
+
+	job := UploadJob{MessageID: "file-1", Type: "file", FileName: "recording.mov", FileSize: 2 << 20}
+	receipts := NewReceipts()
+	if pipeline.admitUpload(job, "reply-token", receipts) {
+		t.Fatal("admitUpload() accepted a file over the size limit")
+	}
+	pipeline.sendReceipts(receipts)
+
+	bot := pipeline.bot.(*mockBot)
+	if len(bot.sentMessages) != 1 || !strings.Contains(bot.sentMessages[0], "recording.mov") {
+		t.Errorf("sent %v, want a reply naming the skipped file", bot.sentMessages)
+	}
+
+	pipeline.settings.defaults.NotifySkipped = false
+	bot.sentMessages = nil
+	receipts = NewReceipts()
+	pipeline.admitUpload(job, "reply-token", receipts)
+	pipeline.sendReceipts(receipts)
+	if len(bot.sentMessages) != 0 {
+		t.Errorf("sent %v without notifySkipped", bot.sentMessages)
+	}
+}
+
+func TestProcessUploadSkipsDisallowedContent(t *testing.T) {
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{content: encodeTestPNG(t, 10, 10)}, driveService, newTestConfig())
+	pipeline.settings.defaults = GroupSettings{AllowedFormats: []string{"image/jpeg"}}
+
+	// The webhook says nothing about the format of images, so the detected
+	// PNG type is what gets it rejected
+	job := UploadJob{MessageID: "img-1", Type: "image"}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+	if len(driveService.files.created) != 0 {
+		t.Errorf("uploaded %d files, want none", len(driveService.files.created))
+	}
+}
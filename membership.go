@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// welcomeMessage greets a chat the bot was added to
+func welcomeMessage(locale string) string {
+	return tr(locale, msgWelcome) + "\n\n" + helpText(locale, false)
+}
+
+// handleJoin prepares a group the bot was added to: its folder is created
+// (or brought back from the archive) right away, so /stats can open it
+// before the first upload, and the group is greeted.
+func (p *Pipeline) handleJoin(groupID, replyToken string) {
+	if groupID != "" {
+		p.groupCache.SetArchived(groupID, time.Time{})
+		if err := p.restoreChatFolder(groupFolderName(groupID)); err != nil {
+			log.Printf("Error restoring folder of %s: %v", groupID, err)
+		}
+		if folderID, err := p.chatFolder("", groupID); err != nil {
+			log.Printf("Error creating folder for %s: %v", groupID, err)
+		} else {
+			p.groupCache.SetFolder(chatKey("", groupID), folderID)
+		}
+		log.Printf("Joined group %s", groupID)
+	}
+	sendMessage(p.bot, replyToken, welcomeMessage(p.chatLocale("", groupID)))
+}
+
+// handleLeave marks a group the bot was removed from as archived and, with
+// ARCHIVE_FOLDER_ID set, moves its folder there.
+func (p *Pipeline) handleLeave(groupID string) {
+	if groupID == "" {
+		return
+	}
+	p.groupCache.SetArchived(groupID, time.Now())
+	log.Printf("Left group %s", groupID)
+
+	if p.config.ArchiveFolderID == "" {
+		return
+	}
+	if err := p.moveChatFolder(groupFolderName(groupID), p.config.GoogleDriveFolderID, p.config.ArchiveFolderID); err != nil {
+		log.Printf("Error archiving folder of %s: %v", groupID, err)
+	}
+}
+
+// restoreChatFolder moves a chat's folder back from the archive folder when
+// the bot is invited or followed again, so its uploads continue in the same
+// folder.
+func (p *Pipeline) restoreChatFolder(name string) error {
+	if p.config.ArchiveFolderID == "" {
+		return nil
+	}
+	return p.moveChatFolder(name, p.config.ArchiveFolderID, p.config.GoogleDriveFolderID)
+}
+
+// moveChatFolder moves the folder called name from one parent to another.
+// A chat without a folder under from is left alone.
+func (p *Pipeline) moveChatFolder(name, from, to string) error {
+	folderID, ok, err := findFolder(p.drive, name, from)
+	if err != nil || !ok {
+		return err
+	}
+	if _, err := p.drive.Files().MoveFile(folderID, to, from); err != nil {
+		return fmt.Errorf("failed to move folder %q: %v", name, err)
+	}
+	p.folders.Forget(from, name)
+	p.folders.Set(to, name, folderID)
+	log.Printf("Moved folder %s to %s", name, to)
+	return nil
+}
+
+// handleFollow prepares the folder of a user who added the bot as a friend
+// or unblocked it, and greets them.
+func (p *Pipeline) handleFollow(userID, replyToken string) {
+	if userID != "" {
+		p.groupCache.SetArchived(userID, time.Time{})
+		if err := p.restoreChatFolder(userFolderName(userID)); err != nil {
+			log.Printf("Error restoring folder of %s: %v", userID, err)
+		}
+		if _, err := p.chatFolder(userID, ""); err != nil {
+			log.Printf("Error creating folder for %s: %v", userID, err)
+		}
+		log.Printf("Followed by %s", userID)
+	}
+	sendMessage(p.bot, replyToken, welcomeMessage(p.chatLocale(userID, "")))
+}
+
+// handleUnfollow retires the folder of a user who blocked the bot: their
+// stats are marked archived and, with ARCHIVE_FOLDER_ID set, their folder is
+// moved there.
+func (p *Pipeline) handleUnfollow(userID string) {
+	if userID == "" {
+		return
+	}
+	p.groupCache.SetArchived(userID, time.Now())
+	log.Printf("Unfollowed by %s", userID)
+
+	if p.config.ArchiveFolderID == "" {
+		return
+	}
+	if err := p.moveChatFolder(userFolderName(userID), p.config.GoogleDriveFolderID, p.config.ArchiveFolderID); err != nil {
+		log.Printf("Error archiving folder of %s: %v", userID, err)
+	}
+}
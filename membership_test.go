@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestHandleJoin(t *testing.T) {
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{}, driveService, newTestConfig())
+	pipeline.groupCache.SetArchived("group-1", time.Now())
+
+	pipeline.handleJoin("group-1", "reply-token")
+
+	created := driveService.files.created
+	if len(created) != 1 || created[0].Name != groupFolderName("group-1") {
+		t.Errorf("created %v, want the group folder", created)
+	}
+	bot := pipeline.bot.(*mockBot)
+	if len(bot.sentMessages) != 1 || !strings.Contains(bot.sentMessages[0], "/help") {
+		t.Errorf("sent %v, want the welcome message", bot.sentMessages)
+	}
+	if !pipeline.groupCache.ArchivedAt("group-1").IsZero() {
+		t.Error("rejoined group is still archived")
+	}
+	if got := pipeline.groupCache.Folder("group-1"); got != "mock-file-id" {
+		t.Errorf("Folder() = %q, want the new folder for /stats", got)
+	}
+}
+
+func TestHandleLeave(t *testing.T) {
+	driveService := newMockDriveService()
+	groupFolder := &drive.File{Id: "group-folder", Name: groupFolderName("group-1")}
+	driveService.files.existing = []*drive.File{groupFolder}
+	config := newTestConfig()
+	config.ArchiveFolderID = "archive-folder"
+	pipeline := newTestPipeline(&mockBlobAPI{}, driveService, config)
+
+	pipeline.handleLeave("group-1")
+
+	if pipeline.groupCache.ArchivedAt("group-1").IsZero() {
+		t.Error("group was not marked archived")
+	}
+	if moved := driveService.files.moved; len(moved) != 1 || moved[0] != "group-folder -> archive-folder" {
+		t.Errorf("moved %v, want the group folder in the archive", moved)
+	}
+	if id, ok := pipeline.folders.Get(config.GoogleDriveFolderID, groupFolder.Name); ok {
+		t.Errorf("folder cache still points at %s in the root folder", id)
+	}
+
+	// Joining again brings the folder back
+	pipeline.handleJoin("group-1", "")
+	if moved := driveService.files.moved; len(moved) != 2 || moved[1] != "group-folder -> "+config.GoogleDriveFolderID {
+		t.Errorf("moved %v, want the group folder back in the root", moved)
+	}
+}
+
+func TestGroupCacheArchivedRoundTrip(t *testing.T) {
+	path := t.TempDir() + "/groups.json"
+	cache := NewGroupCache()
+	left := time.Date(2024, 5, 16, 9, 0, 0, 0, time.UTC)
+	cache.SetArchived("group-1", left)
+	if err := cache.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewGroupCache()
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.ArchivedAt("group-1"); !got.Equal(left) {
+		t.Errorf("ArchivedAt() = %v, want %v", got, left)
+	}
+}
+
+func TestHandleFollowAndUnfollow(t *testing.T) {
+	driveService := newMockDriveService()
+	config := newTestConfig()
+	config.ArchiveFolderID = "archive-folder"
+	pipeline := newTestPipeline(&mockBlobAPI{}, driveService, config)
+
+	pipeline.handleFollow("user-1", "reply-token")
+	created := driveService.files.created
+	if len(created) != 1 || created[0].Name != userFolderName("user-1") {
+		t.Fatalf("created %v, want the user's folder", created)
+	}
+
+	driveService.files.existing = []*drive.File{{Id: "user-folder", Name: userFolderName("user-1")}}
+	pipeline.handleUnfollow("user-1")
+	if pipeline.groupCache.ArchivedAt("user-1").IsZero() {
+		t.Error("user was not marked archived")
+	}
+	if moved := driveService.files.moved; len(moved) != 1 || moved[0] != "user-folder -> archive-folder" {
+		t.Errorf("moved %v, want the user's folder in the archive", moved)
+	}
+}
+
+func TestDirectUploadsGoToUserFolder(t *testing.T) {
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("hello")}, driveService, newTestConfig())
+
+	job := UploadJob{MessageID: "msg-1", Type: "file", FileName: "notes.txt", UserID: "user-1"}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+
+	created := driveService.files.created
+	if created[0].Name != userFolderName("user-1") || created[0].Parents[0] != pipeline.config.GoogleDriveFolderID {
+		t.Errorf("first created %q in %v, want the user's folder in the root", created[0].Name, created[0].Parents)
+	}
+	if uploads, _, _ := pipeline.groupCache.GetStats("user-1"); uploads != 1 {
+		t.Errorf("user stats = %d uploads, want 1", uploads)
+	}
+	if uploads, _, _ := pipeline.groupCache.GetStats("direct"); uploads != 0 {
+		t.Errorf("shared direct stats = %d uploads, want 0", uploads)
+	}
+}
+
+func TestRoomsAreChatsOfTheirOwn(t *testing.T) {
+	userID, groupID := getSourceIDs(webhook.RoomSource{UserId: "user-1", RoomId: "R0123"})
+	if userID != "user-1" || groupID != "R0123" {
+		t.Fatalf("getSourceIDs() = %q, %q; want the room as the chat", userID, groupID)
+	}
+
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("hello")}, driveService, newTestConfig())
+	job := UploadJob{MessageID: "msg-1", Type: "file", FileName: "notes.txt", UserID: userID, GroupID: groupID}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+	if name := driveService.files.created[0].Name; name != "LINE-Room-R0123" {
+		t.Errorf("folder = %q, want LINE-Room-R0123", name)
+	}
+	if uploads, _, _ := pipeline.groupCache.GetStats("R0123"); uploads != 1 {
+		t.Errorf("room stats = %d uploads, want 1", uploads)
+	}
+
+	bot := newMockBot()
+	handleCommand(bot, "/stats", "", groupID, "reply-token", pipeline.groupCache, localeEnglish, false)
+	if !strings.Contains(bot.sentMessages[0], "Room Statistics") {
+		t.Errorf("/stats = %q, want room statistics", bot.sentMessages[0])
+	}
+}
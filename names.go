@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// ProfileAPI looks up the display names used in file name templates.
+// *messaging_api.MessagingApiAPI implements it.
+type ProfileAPI interface {
+	GetProfile(userId string) (*messaging_api.UserProfileResponse, error)
+	GetGroupMemberProfile(groupId, userId string) (*messaging_api.GroupUserProfileResponse, error)
+	GetGroupSummary(groupId string) (*messaging_api.GroupSummaryResponse, error)
+	GetRoomMemberProfile(roomId, userId string) (*messaging_api.RoomUserProfileResponse, error)
+}
+
+// fileNamePlaceholders lists what a FILE_NAME_TEMPLATE may contain
+var fileNamePlaceholders = map[string]bool{
+	"{date}":     true, // capture or upload date, 2006-01-02
+	"{time}":     true, // capture or upload time, 150405
+	"{datetime}": true, // 20060102-150405
+	"{sender}":   true, // display name of the sender
+	"{group}":    true, // name of the group, or "room" or "direct"
+	"{id}":       true, // LINE message ID
+	"{name}":     true, // original file name without extension, or the media type
+	"{type}":     true, // image, video, audio or file
+}
+
+var placeholderPattern = regexp.MustCompile(`\{[a-z]+\}`)
+
+// validateFileNameTemplate rejects templates with unknown placeholders
+func validateFileNameTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		if !fileNamePlaceholders[placeholder] {
+			return fmt.Errorf("invalid FILE_NAME_TEMPLATE: unknown placeholder %s", placeholder)
+		}
+	}
+	return nil
+}
+
+// templateUsesNames reports whether rendering the template needs display
+// names, which cost an API call to look up.
+func templateUsesNames(template string) bool {
+	return strings.Contains(template, "{sender}") || strings.Contains(template, "{group}")
+}
+
+// chatNames are the display names of where a message came from
+type chatNames struct {
+	Sender string
+	Group  string
+}
+
+// fileNameFields are the values available to a file name template
+type fileNameFields struct {
+	Time      time.Time
+	MessageID string
+	Type      string
+	FileName  string // original name of file messages
+	Names     chatNames
+}
+
+// renderFileName fills in the template and appends the extension. Values
+// cannot introduce path separators.
+func renderFileName(template string, fields fileNameFields, ext string) string {
+	name := strings.TrimSuffix(fields.FileName, ext)
+	if name == "" {
+		name = fields.Type
+	}
+
+	clean := strings.NewReplacer("/", "_", "\\", "_")
+	replacer := strings.NewReplacer(
+		"{date}", fields.Time.Format("2006-01-02"),
+		"{time}", fields.Time.Format("150405"),
+		"{datetime}", fields.Time.Format("20060102-150405"),
+		"{sender}", clean.Replace(fields.Names.Sender),
+		"{group}", clean.Replace(fields.Names.Group),
+		"{id}", clean.Replace(fields.MessageID),
+		"{name}", clean.Replace(name),
+		"{type}", fields.Type,
+	)
+	return replacer.Replace(template) + ext
+}
+
+// messageType names the media type of a message for templates
+func messageType(message webhook.MessageContentInterface) string {
+	switch message.(type) {
+	case webhook.ImageMessageContent:
+		return "image"
+	case webhook.VideoMessageContent:
+		return "video"
+	case webhook.AudioMessageContent:
+		return "audio"
+	case webhook.FileMessageContent:
+		return "file"
+	}
+	return "unknown"
+}
+
+// nameCacheTTL is how long looked up display names are reused; people and
+// groups rename themselves now and then
+const nameCacheTTL = time.Hour
+
+// NameCache remembers display names so every upload does not cost a lookup
+type NameCache struct {
+	entries map[string]nameEntry
+	mu      sync.Mutex
+}
+
+type nameEntry struct {
+	name    string
+	fetched time.Time
+}
+
+func NewNameCache() *NameCache {
+	return &NameCache{
+		entries: make(map[string]nameEntry),
+	}
+}
+
+// lookup returns the cached name for key or fetches it. Failed or empty
+// lookups fall back to fallback, which is cached like a name so they are not
+// retried on every message.
+func (c *NameCache) lookup(key, fallback string, fetch func() (string, error)) string {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetched) < nameCacheTTL {
+		return entry.name
+	}
+
+	name, err := fetch()
+	if err != nil {
+		log.Printf("Error looking up name for %s: %v", key, err)
+	}
+	if err != nil || name == "" {
+		name = fallback
+	}
+
+	c.mu.Lock()
+	c.entries[key] = nameEntry{name: name, fetched: time.Now()}
+	c.mu.Unlock()
+	return name
+}
+
+// chatNames looks up the sender and group names of a job when the naming
+// template needs them.
+func (p *Pipeline) chatNames(job UploadJob) chatNames {
+	if !templateUsesNames(p.config.FileNameTemplate) {
+		return chatNames{}
+	}
+	return p.lookupNames(job.UserID, job.GroupID)
+}
+
+// lookupNames returns the display names of a sender and their group or
+// room. Unknown names fall back to the IDs.
+func (p *Pipeline) lookupNames(userID, groupID string) chatNames {
+	names := chatNames{Sender: userID, Group: "direct"}
+	switch {
+	case isRoomID(groupID):
+		// Rooms have no name
+		names.Group = "room"
+	case groupID != "":
+		names.Group = groupID
+	}
+	if p.profiles == nil {
+		return names
+	}
+
+	if userID != "" {
+		names.Sender = p.names.lookup("user:"+groupID+":"+userID, userID, func() (string, error) {
+			if isRoomID(groupID) {
+				profile, err := p.profiles.GetRoomMemberProfile(groupID, userID)
+				if err != nil {
+					return "", err
+				}
+				return profile.DisplayName, nil
+			}
+			if groupID != "" {
+				profile, err := p.profiles.GetGroupMemberProfile(groupID, userID)
+				if err != nil {
+					return "", err
+				}
+				return profile.DisplayName, nil
+			}
+			profile, err := p.profiles.GetProfile(userID)
+			if err != nil {
+				return "", err
+			}
+			return profile.DisplayName, nil
+		})
+	}
+	if groupID != "" && !isRoomID(groupID) {
+		names.Group = p.names.lookup("group:"+groupID, groupID, func() (string, error) {
+			summary, err := p.profiles.GetGroupSummary(groupID)
+			if err != nil {
+				return "", err
+			}
+			return summary.GroupName, nil
+		})
+	}
+	return names
+}
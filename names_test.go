@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+type mockProfileAPI struct {
+	calls int
+}
+
+func (m *mockProfileAPI) GetProfile(userId string) (*messaging_api.UserProfileResponse, error) {
+	m.calls++
+	return &messaging_api.UserProfileResponse{DisplayName: "Direct " + userId, Language: "ja"}, nil
+}
+
+func (m *mockProfileAPI) GetGroupMemberProfile(groupId, userId string) (*messaging_api.GroupUserProfileResponse, error) {
+	m.calls++
+	if userId == "unknown" {
+		return nil, errors.New("not found")
+	}
+	return &messaging_api.GroupUserProfileResponse{DisplayName: "Alice/Bob"}, nil
+}
+
+func (m *mockProfileAPI) GetGroupSummary(groupId string) (*messaging_api.GroupSummaryResponse, error) {
+	m.calls++
+	return &messaging_api.GroupSummaryResponse{GroupName: "Family"}, nil
+}
+
+func (m *mockProfileAPI) GetRoomMemberProfile(roomId, userId string) (*messaging_api.RoomUserProfileResponse, error) {
+	m.calls++
+	return &messaging_api.RoomUserProfileResponse{DisplayName: "Carol"}, nil
+}
+
+func TestRenderFileName(t *testing.T) {
+	fields := fileNameFields{
+		Time:      time.Date(2024, 5, 17, 9, 30, 15, 0, time.UTC),
+		MessageID: "123",
+		Type:      "image",
+		Names:     chatNames{Sender: "Alice/Bob", Group: "Family"},
+	}
+
+	tests := []struct {
+		template string
+		fields   fileNameFields
+		ext      string
+		want     string
+	}{
+		{"{date}-{sender}-{id}", fields, ".jpg", "2024-05-17-Alice_Bob-123.jpg"},
+		{"{group}_{datetime}", fields, ".jpg", "Family_20240517-093015.jpg"},
+		{"{time}-{type}-{name}", fields, ".mp4", "093015-image-image.mp4"},
+		{"{name}-{id}", fileNameFields{MessageID: "9", Type: "file", FileName: "report.pdf"}, ".pdf", "report-9.pdf"},
+	}
+
+	for _, tt := range tests {
+		if got := renderFileName(tt.template, tt.fields, tt.ext); got != tt.want {
+			t.Errorf("renderFileName(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFileNameTemplate(t *testing.T) {
+	if err := validateFileNameTemplate("{date}-{sender}-{group}-{id}-{name}"); err != nil {
+		t.Errorf("validateFileNameTemplate() error: %v", err)
+	}
+	if err := validateFileNameTemplate("{date}-{author}"); err == nil {
+		t.Error("Expected error for unknown placeholder")
+	}
+}
+
+func TestChatNames(t *testing.T) {
+	profiles := &mockProfileAPI{}
+	config := newTestConfig()
+	config.FileNameTemplate = "{group}-{sender}-{id}"
+	pipeline := newTestPipeline(&mockBlobAPI{}, newMockDriveService(), config)
+	pipeline.profiles = profiles
+
+	job := UploadJob{MessageID: "1", Type: "image", UserID: "user-1", GroupID: "group-1"}
+	names := pipeline.chatNames(job)
+	if names.Sender != "Alice/Bob" || names.Group != "Family" {
+		t.Errorf("chatNames() = %+v, want Alice/Bob in Family", names)
+	}
+
+	// Names are cached
+	pipeline.chatNames(job)
+	if profiles.calls != 2 {
+		t.Errorf("profile API called %d times, want 2", profiles.calls)
+	}
+
+	// Lookups that fail fall back to the ID
+	names = pipeline.chatNames(UploadJob{UserID: "unknown", GroupID: "group-1"})
+	if names.Sender != "unknown" {
+		t.Errorf("chatNames() sender = %q, want the user ID", names.Sender)
+	}
+
+	names = pipeline.chatNames(UploadJob{UserID: "user-2"})
+	if names.Sender != "Direct user-2" || names.Group != "direct" {
+		t.Errorf("chatNames() for a direct message = %+v", names)
+	}
+
+	// Nothing is looked up when the template does not need names
+	config.FileNameTemplate = "{date}-{id}"
+	profiles.calls = 0
+	pipeline.chatNames(UploadJob{UserID: "user-3", GroupID: "group-3"})
+	if profiles.calls != 0 {
+		t.Errorf("profile API called %d times, want none", profiles.calls)
+	}
+}
+
+func TestHandleFileAppliesTemplate(t *testing.T) {
+	driveService := newMockDriveService()
+	config := &Config{GoogleDriveFolderID: "root-folder", FileNameTemplate: "{group}-{sender}-{name}"}
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("%PDF-1.4")}, driveService, config)
+
+	message := webhook.FileMessageContent{Id: "file-1", FileName: "minutes.pdf"}
+	names := chatNames{Sender: "Alice", Group: "Family"}
+	if _, err := pipeline.handleFile(context.Background(), message, "file-1", ".pdf", "", "root-folder",
+		GroupSettings{}, names); err != nil {
+		t.Fatalf("handleFile() error: %v", err)
+	}
+
+	if got := driveService.files.created[0].Name; got != "Family-Alice-minutes.pdf" {
+		t.Errorf("File name = %q, want Family-Alice-minutes.pdf", got)
+	}
+}
+
+func TestLookupNamesInRoom(t *testing.T) {
+	pipeline := newTestPipeline(&mockBlobAPI{}, newMockDriveService(), newTestConfig())
+	pipeline.profiles = &mockProfileAPI{}
+
+	names := pipeline.lookupNames("user-1", "R0123")
+	if names.Sender != "Carol" || names.Group != "room" {
+		t.Errorf("lookupNames() = %+v, want Carol in a room", names)
+	}
+}
+
+func TestNameCacheRemembersFailures(t *testing.T) {
+	cache := NewNameCache()
+	calls := 0
+	failing := func() (string, error) { calls++; return "", errors.New("not found") }
+	empty := func() (string, error) { calls++; return "", nil }
+
+	for i := 0; i < 2; i++ {
+		if got := cache.lookup("user:failing", "fallback", failing); got != "fallback" {
+			t.Errorf("lookup() = %q, want the fallback", got)
+		}
+		if got := cache.lookup("language:empty", "", empty); got != "" {
+			t.Errorf("lookup() = %q, want nothing", got)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("fetched %d times, want each key once", calls)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// Pipeline holds the long-lived clients and caches used to archive media.
+// It is built once in main and shared by every webhook delivery.
+type Pipeline struct {
+	bot           MessageSender
+	blob          BlobAPI
+	external      *ExternalContentClient
+	profiles      ProfileAPI
+	names         *NameCache
+	drive         DriveService
+	messageCache  *MessageCache
+	groupCache    *GroupCache
+	tracker       *UploadTracker
+	folders       *FolderCache
+	settings      *Settings
+	contactSheets *ContactSheets
+	transcripts   *Transcripts
+	places        *Places
+	scanner       *ClamAVScanner // nil when virus scanning is disabled
+	config        *Config
+}
+
+// chatKey identifies a chat in the stats: the group, or the user for
+// direct messages.
+func chatKey(userID, groupID string) string {
+	if groupID != "" {
+		return groupID
+	}
+	if userID != "" {
+		return userID
+	}
+	return "direct"
+}
+
+// chatFolderName names the folder a chat is archived in
+func chatFolderName(userID, groupID string) string {
+	if groupID != "" {
+		return groupFolderName(groupID)
+	}
+	return userFolderName(userID)
+}
+
+// chatFolder returns the folder a chat is archived in, creating it if
+// needed. Direct messages go into a folder per user; messages without a
+// known sender go into the root folder.
+func (p *Pipeline) chatFolder(userID, groupID string) (string, error) {
+	if groupID == "" && userID == "" {
+		return p.config.GoogleDriveFolderID, nil
+	}
+	return p.folder(chatFolderName(userID, groupID), p.config.GoogleDriveFolderID)
+}
+
+// processUpload archives a media message into the chat's folder and records
+// it in the group stats. What the chat should hear about it goes into
+// receipts.
+func (p *Pipeline) processUpload(ctx context.Context, job UploadJob, replyToken string, receipts *Receipts) error {
+	message := job.Message()
+	if message == nil {
+		return fmt.Errorf("unsupported upload job type: %q", job.Type)
+	}
+
+	folderID, err := p.chatFolder(job.UserID, job.GroupID)
+	if err != nil {
+		return err
+	}
+
+	// Handle the file upload
+	settings := p.settings.ForGroup(job.GroupID)
+	names := p.chatNames(job)
+	result, err := p.handleFileMessage(ctx, message, getFileExtension(message), replyToken, folderID, settings, names)
+	var notAllowed *mediaNotAllowedError
+	if errors.As(err, &notAllowed) {
+		p.reportSkipped(job, settings, replyToken, receipts, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		// Already archived
+		return nil
+	}
+	if result.Threat != "" {
+		p.reportQuarantined(job, result)
+		note := msgNoteQuarantined
+		if result.Threat == oversizeThreat {
+			note = msgNoteUnscanned
+		}
+		receipts.Note(job, replyToken, localize(note, result.File.Name))
+		return nil
+	}
+
+	receipts.Saved(job, replyToken, result.File.Name, result.FolderID)
+
+	// A missing thumbnail is not worth failing the upload over
+	if result.Content != nil {
+		if err := p.createThumbnail(result, folderID, job.MessageID); err != nil {
+			log.Printf("Error creating thumbnail for %s: %v", result.File.Name, err)
+		}
+	}
+
+	// Track uploads per chat; direct messages count for their sender
+	trackingGroupID := chatKey(job.UserID, job.GroupID)
+	p.groupCache.SetFolder(trackingGroupID, folderID)
+	if job.ImageSetID != "" {
+		name := imageSetFolderName(job.ImageSetID)
+		if job.ImageSetTotal > 0 {
+			name = fmt.Sprintf("%s (%d photos)", name, job.ImageSetTotal)
+		}
+		p.groupCache.AddImageSet(trackingGroupID, job.ImageSetID, name, folderURL(result.FolderID))
+		return nil
+	}
+	// Record the stored name, which reflects the detected type and template
+	p.groupCache.AddUploadedFile(trackingGroupID, result.File.Name, fileURL(result.File.Id))
+	return nil
+}
+
+// requeuePendingUploads processes the jobs persisted by the previous run in
+// the background.
+func (p *Pipeline) requeuePendingUploads(ctx context.Context) {
+	jobs, err := loadPendingUploads(filepath.Join(p.config.StateDir, pendingUploadsFile))
+	if err != nil {
+		log.Printf("Error loading pending uploads: %v", err)
+		return
+	}
+	if len(jobs) == 0 || !p.tracker.Accept(jobs) {
+		return
+	}
+
+	log.Printf("Retrying %d pending uploads from the previous run", len(jobs))
+	go func() {
+		defer p.tracker.Done(jobs)
+		// The reply tokens are long gone, so the chats are told by push
+		receipts := NewReceipts()
+		for _, job := range jobs {
+			p.runUpload(ctx, job, "", receipts)
+		}
+		p.sendReceipts(receipts)
+	}()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// EXIF tags removed in privacy mode
+const (
+	tagArtist           = 0x013B
+	tagXPAuthor         = 0x9C9D
+	tagGPSIFDPointer    = 0x8825
+	tagMakerNote        = 0x927C
+	tagCameraOwnerName  = 0xA430
+	tagBodySerialNumber = 0xA431
+	tagLensSerialNumber = 0xA435
+)
+
+var privateTags = map[uint16]bool{
+	tagArtist:           true,
+	tagXPAuthor:         true,
+	tagGPSIFDPointer:    true,
+	tagMakerNote:        true, // vendor blob, commonly holds serial numbers
+	tagCameraOwnerName:  true,
+	tagBodySerialNumber: true,
+	tagLensSerialNumber: true,
+}
+
+// PNG text chunk keywords that carry XMP/EXIF copies or the author
+var privatePNGKeywords = map[string]bool{
+	"XML:com.adobe.xmp":        true,
+	"Author":                   true,
+	"Raw profile type exif":    true,
+	"Raw profile type APP1":    true,
+	"Raw profile type xmp":     true,
+	"Raw profile type iptc":    true,
+	"Raw profile type 8bim":    true,
+	"Raw profile type generic": true,
+}
+
+var errMalformedImage = errors.New("malformed image metadata")
+
+// supportsMetadataStripping reports whether stripPrivateMetadata can handle
+// the given type.
+func supportsMetadataStripping(mimeType string) bool {
+	return mimeType == "image/jpeg" || mimeType == "image/png"
+}
+
+// stripPrivateMetadata returns a reader producing r with GPS, owner and
+// serial number metadata removed. Pixel data is copied unchanged. Malformed
+// input makes the returned reader fail rather than leak the original. The
+// caller must close the reader to release the worker goroutine.
+func stripPrivateMetadata(r io.Reader, mimeType string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		switch mimeType {
+		case "image/jpeg":
+			err = stripJPEG(bufio.NewReader(r), pw)
+		case "image/png":
+			err = stripPNG(bufio.NewReader(r), pw)
+		default:
+			_, err = io.Copy(pw, r)
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// stripJPEG rewrites the segments in front of the image data. APP1 EXIF is
+// scrubbed in place, XMP and Photoshop/IPTC segments are dropped.
+func stripJPEG(r *bufio.Reader, w io.Writer) error {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return errMalformedImage
+	}
+	if _, err := w.Write(soi); err != nil {
+		return err
+	}
+
+	for {
+		marker := make([]byte, 2)
+		if _, err := io.ReadFull(r, marker); err != nil || marker[0] != 0xFF {
+			return errMalformedImage
+		}
+
+		// Start of scan: the rest is image data
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			if _, err := w.Write(marker); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, r)
+			return err
+		}
+
+		lengthBytes := make([]byte, 2)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return errMalformedImage
+		}
+		length := int(binary.BigEndian.Uint16(lengthBytes))
+		if length < 2 {
+			return errMalformedImage
+		}
+		payload := make([]byte, length-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return errMalformedImage
+		}
+
+		switch {
+		case marker[1] == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			if err := scrubTIFF(payload[6:]); err != nil {
+				return err
+			}
+		case marker[1] == 0xE1 || marker[1] == 0xED:
+			// XMP (APP1) or Photoshop/IPTC (APP13), both may hold locations
+			continue
+		}
+
+		for _, part := range [][]byte{marker, lengthBytes, payload} {
+			if _, err := w.Write(part); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// stripPNG copies the chunks of a PNG, scrubbing eXIf and dropping text
+// chunks that contain metadata copies or the author.
+func stripPNG(r *bufio.Reader, w io.Writer) error {
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(r, signature); err != nil || !bytes.Equal(signature, []byte("\x89PNG\r\n\x1a\n")) {
+		return errMalformedImage
+	}
+	if _, err := w.Write(signature); err != nil {
+		return err
+	}
+
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errMalformedImage
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:8])
+
+		// Stream image data without buffering it
+		if chunkType == "IDAT" {
+			if _, err := w.Write(header); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, size+4); err != nil {
+				return errMalformedImage
+			}
+			continue
+		}
+
+		if size > 16<<20 {
+			return fmt.Errorf("%w: oversized %s chunk", errMalformedImage, chunkType)
+		}
+		body := make([]byte, size+4) // data + CRC
+		if _, err := io.ReadFull(r, body); err != nil {
+			return errMalformedImage
+		}
+		data := body[:size]
+
+		switch chunkType {
+		case "eXIf":
+			if err := scrubTIFF(data); err != nil {
+				return err
+			}
+			binary.BigEndian.PutUint32(body[size:], crc32.ChecksumIEEE(append([]byte(chunkType), data...)))
+		case "tEXt", "zTXt", "iTXt":
+			keyword, _, _ := bytes.Cut(data, []byte{0})
+			if privatePNGKeywords[string(keyword)] {
+				continue
+			}
+		}
+
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
+
+// exifTypeSizes maps TIFF field types to the size of one value
+var exifTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+// scrubTIFF removes private tags from an EXIF TIFF block in place. Removed
+// entries are cut from their IFD and the values they pointed to are zeroed,
+// so no offsets elsewhere in the file change.
+func scrubTIFF(data []byte) error {
+	r, ok := newTIFFReader(data)
+	if !ok {
+		return errMalformedImage
+	}
+
+	// IFD0 (main image) and IFD1 (thumbnail)
+	offset, _ := r.uint32At(4)
+	for n := 0; offset != 0 && n < 2; n++ {
+		next, err := r.scrubIFD(int(offset), true)
+		if err != nil {
+			return err
+		}
+		offset = next
+	}
+	return nil
+}
+
+// scrubIFD removes private entries from the IFD at off, descending into the
+// Exif sub-IFD when asked to. It returns the offset of the next IFD.
+func (r *tiffReader) scrubIFD(off int, descend bool) (uint32, error) {
+	count, ok := r.uint16At(off)
+	if !ok || off+2+int(count)*12+4 > len(r.data) {
+		return 0, errMalformedImage
+	}
+
+	n := int(count)
+	for i := 0; i < n; {
+		base := off + 2 + i*12
+		tag, _ := r.uint16At(base)
+
+		if tag == tagExifIFDPointer && descend {
+			if sub, ok := r.uint32At(base + 8); ok {
+				if _, err := r.scrubIFD(int(sub), false); err != nil {
+					return 0, err
+				}
+			}
+		}
+
+		if !privateTags[tag] {
+			i++
+			continue
+		}
+
+		if tag == tagGPSIFDPointer {
+			if gps, ok := r.uint32At(base + 8); ok {
+				r.zeroIFD(int(gps))
+			}
+		} else {
+			r.zeroValue(base)
+		}
+
+		// Shift the following entries and the next-IFD offset up by one
+		end := off + 2 + n*12 + 4
+		copy(r.data[base:], r.data[base+12:end])
+		clear(r.data[end-12 : end])
+		n--
+		r.order.PutUint16(r.data[off:], uint16(n))
+	}
+
+	next, _ := r.uint32At(off + 2 + n*12)
+	return next, nil
+}
+
+// zeroValue clears the out-of-line value of the entry at base
+func (r *tiffReader) zeroValue(base int) {
+	typ, _ := r.uint16At(base + 2)
+	count, _ := r.uint32At(base + 4)
+	size := exifTypeSizes[typ] * int(count)
+	if size <= 4 {
+		clear(r.data[base+8 : base+12])
+		return
+	}
+
+	valueOffset, ok := r.uint32At(base + 8)
+	if !ok {
+		return
+	}
+	start, end := int(valueOffset), int(valueOffset)+size
+	if start < 0 || end > len(r.data) || end < start {
+		return
+	}
+	clear(r.data[start:end])
+}
+
+// zeroIFD clears an IFD and every value it points to
+func (r *tiffReader) zeroIFD(off int) {
+	count, ok := r.uint16At(off)
+	if !ok || off+2+int(count)*12+4 > len(r.data) {
+		return
+	}
+	for i := 0; i < int(count); i++ {
+		r.zeroValue(off + 2 + i*12)
+	}
+	clear(r.data[off : off+2+int(count)*12+4])
+}
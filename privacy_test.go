@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // stored out of line when longer than 4 bytes
+}
+
+func asciiField(tag uint16, s string) tiffField {
+	return tiffField{tag: tag, typ: exifTypeASCII, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+// buildPrivateTIFF returns a little-endian TIFF block with an artist, a GPS
+// position and a camera serial number alongside the capture date.
+func buildPrivateTIFF() []byte {
+	le := binary.LittleEndian
+	latitude := make([]byte, 24) // 3 rationals: 35/1 41/1 2211/100
+	for i, v := range []uint32{35, 1, 41, 1, 2211, 100} {
+		le.PutUint32(latitude[i*4:], v)
+	}
+
+	ifd0 := []tiffField{asciiField(tagArtist, "Jane Doe Photography")}
+	exif := []tiffField{
+		asciiField(tagDateTimeOriginal, "2024:05:17 14:30:05"),
+		asciiField(tagBodySerialNumber, "SN0123456789"),
+	}
+	gps := []tiffField{
+		{tag: 0x0001, typ: exifTypeASCII, count: 2, value: []byte("N\x00")},
+		{tag: 0x0002, typ: 5, count: 3, value: latitude},
+	}
+
+	ifdSize := func(entries int) int { return 2 + 12*entries + 4 }
+	ifd0Off := 8
+	exifOff := ifd0Off + ifdSize(len(ifd0)+2) // plus the Exif and GPS pointers
+	gpsOff := exifOff + ifdSize(len(exif))
+	dataOff := gpsOff + ifdSize(len(gps))
+
+	buf := make([]byte, dataOff)
+	copy(buf, "II*\x00")
+	le.PutUint32(buf[4:], uint32(ifd0Off))
+
+	writeIFD := func(off int, fields []tiffField) {
+		le.PutUint16(buf[off:], uint16(len(fields)))
+		for i, f := range fields {
+			base := off + 2 + i*12
+			le.PutUint16(buf[base:], f.tag)
+			le.PutUint16(buf[base+2:], f.typ)
+			le.PutUint32(buf[base+4:], f.count)
+			if len(f.value) <= 4 {
+				copy(buf[base+8:], f.value)
+			} else {
+				le.PutUint32(buf[base+8:], uint32(len(buf)))
+				buf = append(buf, f.value...)
+			}
+		}
+	}
+
+	pointer := func(tag uint16, off int) tiffField {
+		v := make([]byte, 4)
+		le.PutUint32(v, uint32(off))
+		return tiffField{tag: tag, typ: 4, count: 1, value: v}
+	}
+	writeIFD(ifd0Off, append(ifd0, pointer(tagExifIFDPointer, exifOff), pointer(tagGPSIFDPointer, gpsOff)))
+	writeIFD(exifOff, exif)
+	writeIFD(gpsOff, gps)
+	return buf
+}
+
+func TestScrubTIFF(t *testing.T) {
+	tiff := buildPrivateTIFF()
+	if err := scrubTIFF(tiff); err != nil {
+		t.Fatalf("scrubTIFF() error: %v", err)
+	}
+
+	for _, secret := range []string{"Jane Doe", "SN0123456789"} {
+		if bytes.Contains(tiff, []byte(secret)) {
+			t.Errorf("Scrubbed TIFF still contains %q", secret)
+		}
+	}
+	if bytes.Contains(tiff, []byte{35, 0, 0, 0, 1, 0, 0, 0, 41, 0, 0, 0}) {
+		t.Error("Scrubbed TIFF still contains the GPS latitude")
+	}
+
+	r := &tiffReader{data: tiff, order: binary.LittleEndian}
+	ifd0 := r.readIFD(8)
+	if _, ok := ifd0[tagGPSIFDPointer]; ok {
+		t.Error("GPS IFD pointer should be removed")
+	}
+	if _, ok := ifd0[tagExifIFDPointer]; !ok {
+		t.Error("Exif IFD pointer should be kept")
+	}
+
+	// Non-private fields survive
+	if got, ok := exifCaptureTime(tiff); !ok || got.Format("2006:01:02 15:04:05") != "2024:05:17 14:30:05" {
+		t.Errorf("Capture time after scrub = %v, %v", got, ok)
+	}
+}
+
+func TestStripPrivateMetadataJPEG(t *testing.T) {
+	xmp := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), "<exif:GPSLatitude>35,41N</exif:GPSLatitude>"...)
+	xmpSegment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(xmpSegment[2:], uint16(len(xmp)+2))
+	xmpSegment = append(xmpSegment, xmp...)
+
+	jpeg := buildJPEG(buildPrivateTIFF())
+	// Insert the XMP segment after the EXIF segment, before the scan
+	sos := bytes.Index(jpeg, []byte{0xFF, 0xDA})
+	pixels := append([]byte(nil), jpeg[sos:]...)
+	jpeg = append(append(jpeg[:sos:sos], xmpSegment...), pixels...)
+
+	stripped := stripPrivateMetadata(bytes.NewReader(jpeg), "image/jpeg")
+	defer stripped.Close()
+	out, err := io.ReadAll(stripped)
+	if err != nil {
+		t.Fatalf("stripPrivateMetadata() error: %v", err)
+	}
+
+	for _, secret := range []string{"Jane Doe", "SN0123456789", "GPSLatitude"} {
+		if bytes.Contains(out, []byte(secret)) {
+			t.Errorf("Stripped JPEG still contains %q", secret)
+		}
+	}
+	if !bytes.HasSuffix(out, pixels) {
+		t.Error("Image data should be unchanged")
+	}
+	if _, ok := extractCaptureTime(out, "image/jpeg"); !ok {
+		t.Error("Capture time should survive stripping")
+	}
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := make([]byte, 8)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], chunkType)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(append([]byte(chunkType), data...)))
+	return append(chunk, crc...)
+}
+
+func TestStripPrivateMetadataPNG(t *testing.T) {
+	idat := pngChunk("IDAT", []byte("compressed pixels"))
+	png := []byte("\x89PNG\r\n\x1a\n")
+	png = append(png, pngChunk("IHDR", make([]byte, 13))...)
+	png = append(png, pngChunk("eXIf", buildPrivateTIFF())...)
+	png = append(png, pngChunk("tEXt", []byte("Author\x00Jane Doe"))...)
+	png = append(png, pngChunk("tEXt", []byte("Software\x00Camera App"))...)
+	png = append(png, idat...)
+	png = append(png, pngChunk("IEND", nil)...)
+
+	stripped := stripPrivateMetadata(bytes.NewReader(png), "image/png")
+	defer stripped.Close()
+	out, err := io.ReadAll(stripped)
+	if err != nil {
+		t.Fatalf("stripPrivateMetadata() error: %v", err)
+	}
+
+	for _, secret := range []string{"Jane Doe", "SN0123456789"} {
+		if bytes.Contains(out, []byte(secret)) {
+			t.Errorf("Stripped PNG still contains %q", secret)
+		}
+	}
+	if !bytes.Contains(out, []byte("Camera App")) || !bytes.Contains(out, idat) {
+		t.Error("Unrelated chunks and image data should be kept")
+	}
+
+	// The rewritten eXIf chunk must still carry a valid CRC
+	exif := pngExifData(out)
+	start := bytes.Index(out, []byte("eXIf"))
+	crc := binary.BigEndian.Uint32(out[start+4+len(exif):])
+	if crc != crc32.ChecksumIEEE(out[start:start+4+len(exif)]) {
+		t.Error("eXIf CRC was not updated")
+	}
+}
+
+func TestStripPrivateMetadataMalformed(t *testing.T) {
+	stripped := stripPrivateMetadata(bytes.NewReader([]byte("not a jpeg")), "image/jpeg")
+	defer stripped.Close()
+	if _, err := io.ReadAll(stripped); err == nil {
+		t.Error("Expected error for malformed input")
+	}
+}
+
+func TestHandleFilePrivacyMode(t *testing.T) {
+	photo := buildJPEG(buildPrivateTIFF())
+	driveService := newMockDriveService()
+	config := &Config{GoogleDriveFolderID: "mock-folder"}
+	pipeline := newTestPipeline(&mockBlobAPI{content: photo}, driveService, config)
+	message := webhook.ImageMessageContent{Id: "img-1"}
+
+	if _, err := pipeline.handleFile(context.Background(), message, "img-1", ".jpg", "", "mock-folder",
+		GroupSettings{Privacy: true}, chatNames{}); err != nil {
+		t.Fatalf("handleFile() error: %v", err)
+	}
+	if bytes.Contains(driveService.files.uploaded[0], []byte("Jane Doe")) {
+		t.Error("Uploaded photo should not contain the artist name")
+	}
+	if got := driveService.files.created[0].AppProperties["captureTime"]; got == "" {
+		t.Error("Capture time should still be recorded")
+	} else if _, err := time.Parse(time.RFC3339, got); err != nil {
+		t.Errorf("Invalid captureTime %q", got)
+	}
+
+	// Without privacy mode the photo is archived as is
+	if _, err := pipeline.handleFile(context.Background(), message, "img-1", ".jpg", "", "mock-folder",
+		GroupSettings{}, chatNames{}); err != nil {
+		t.Fatalf("handleFile() error: %v", err)
+	}
+	if !bytes.Equal(driveService.files.uploaded[1], photo) {
+		t.Error("Photo should be unchanged outside privacy mode")
+	}
+}
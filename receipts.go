@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// maxReceiptNames caps the file names listed per folder in one reply
+const maxReceiptNames = 10
+
+// Receipts collects what happened to the uploads of one webhook delivery so
+// each chat gets a single reply instead of one per file. A nil *Receipts
+// records nothing.
+type Receipts struct {
+	mu    sync.Mutex
+	chats []*chatReceipt
+}
+
+func NewReceipts() *Receipts {
+	return &Receipts{}
+}
+
+// chatReceipt is the reply owed to one chat
+type chatReceipt struct {
+	to         string // group, room or user to push to when there is no usable reply token
+	userID     string // first sender seen, whose language the reply may be in
+	groupID    string
+	replyToken string // first reply token seen for the chat
+	saved      []savedFolder
+	notes      []localized // skipped, failed or delayed uploads
+}
+
+// savedFolder lists the files stored in one folder
+type savedFolder struct {
+	folderID string
+	names    []string
+}
+
+// chat returns the receipt of the job's chat, adding it if needed
+func (r *Receipts) chat(job UploadJob, replyToken string) *chatReceipt {
+	to := job.GroupID
+	if to == "" {
+		to = job.UserID
+	}
+	for _, chat := range r.chats {
+		if chat.to == to {
+			if chat.replyToken == "" {
+				chat.replyToken = replyToken
+			}
+			if chat.userID == "" {
+				chat.userID = job.UserID
+			}
+			return chat
+		}
+	}
+	chat := &chatReceipt{to: to, userID: job.UserID, groupID: job.GroupID, replyToken: replyToken}
+	r.chats = append(r.chats, chat)
+	return chat
+}
+
+// Saved records a file stored in folderID
+func (r *Receipts) Saved(job UploadJob, replyToken, name, folderID string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chat := r.chat(job, replyToken)
+	for i := range chat.saved {
+		if chat.saved[i].folderID == folderID {
+			chat.saved[i].names = append(chat.saved[i].names, name)
+			return
+		}
+	}
+	chat.saved = append(chat.saved, savedFolder{folderID: folderID, names: []string{name}})
+}
+
+// Note records a line about an upload that was not stored (yet); it is
+// translated once the reply is sent
+func (r *Receipts) Note(job UploadJob, replyToken string, note localized) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chat := r.chat(job, replyToken)
+	chat.notes = append(chat.notes, note)
+}
+
+// folderURL links to a Drive folder
+func folderURL(folderID string) string {
+	return "https://drive.google.com/drive/folders/" + folderID
+}
+
+// text renders the reply of a chat in locale
+func (c *chatReceipt) text(locale string) string {
+	var lines []string
+	for _, folder := range c.saved {
+		names := folder.names
+		more := ""
+		if len(names) > maxReceiptNames {
+			more = fmt.Sprintf(tr(locale, msgReceiptMore), len(names)-maxReceiptNames)
+			names = names[:maxReceiptNames]
+		}
+		if len(folder.names) == 1 {
+			lines = append(lines, fmt.Sprintf(tr(locale, msgReceiptSaved), names[0], folderURL(folder.folderID)))
+		} else {
+			lines = append(lines, fmt.Sprintf(tr(locale, msgReceiptSavedMany),
+				len(folder.names), strings.Join(names, ", "), more, folderURL(folder.folderID)))
+		}
+	}
+	for _, note := range c.notes {
+		lines = append(lines, note.text(locale))
+	}
+	return strings.Join(lines, "\n\n")
+}
+
+// fileURL links to a Drive file
+func fileURL(fileID string) string {
+	return "https://drive.google.com/file/d/" + fileID + "/view"
+}
+
+// describeUploadError explains a failed upload to the chat. Details that
+// only matter to the operator stay in the log.
+func describeUploadError(err error) localized {
+	switch {
+	case errors.Is(err, errExternalTooLarge):
+		return localize(msgErrTooLarge)
+	case errors.Is(err, errScanTooLarge):
+		return localize(msgErrScanTooLarge)
+	case errors.Is(err, errForbiddenAddress), errors.Is(err, errInvalidContentURL):
+		return localize(msgErrBadLink)
+	case errors.Is(err, context.DeadlineExceeded):
+		return localize(msgErrTimeout)
+	case errors.Is(err, context.Canceled):
+		return localize(msgErrRestarting)
+	}
+	return localize(msgErrUnknown)
+}
+
+// uploadType names a kind of upload, e.g. "image"
+func uploadType(kind string) localized {
+	switch kind {
+	case "image":
+		return localize(msgTypeImage)
+	case "video":
+		return localize(msgTypeVideo)
+	case "audio":
+		return localize(msgTypeAudio)
+	}
+	return localize(msgTypeFile)
+}
+
+// jobName is how a chat would recognize an upload: its file name, or a
+// localized "your image"
+func jobName(job UploadJob) interface{} {
+	if job.FileName != "" {
+		return job.FileName
+	}
+	return localize(msgYourUpload, uploadType(job.Type))
+}
+
+// sendReceipts replies to every chat in r. When a reply token is missing or
+// no longer accepted, the message is pushed to the chat instead.
+func (p *Pipeline) sendReceipts(r *Receipts) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, chat := range r.chats {
+		text := chat.text(p.chatLocale(chat.userID, chat.groupID))
+		if text == "" {
+			continue
+		}
+		if chat.replyToken != "" {
+			err := replyText(p.bot, chat.replyToken, text)
+			if err == nil {
+				continue
+			}
+			log.Printf("Error replying to %s, pushing instead: %v", chat.to, err)
+		}
+		if err := p.push(chat.to, text); err != nil {
+			log.Printf("Error pushing upload receipt to %s: %v", chat.to, err)
+		}
+	}
+}
+
+// replyText answers with a single text message
+func replyText(bot MessageSender, replyToken, text string) error {
+	return replyMessages(bot, replyToken, &messaging_api.TextMessage{Text: text})
+}
+
+// replyMessages answers with the given messages
+func replyMessages(bot MessageSender, replyToken string, messages ...messaging_api.MessageInterface) error {
+	_, err := bot.ReplyMessage(&messaging_api.ReplyMessageRequest{
+		ReplyToken: replyToken,
+		Messages:   messages,
+	})
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+func TestReceiptsCoalescePerChat(t *testing.T) {
+	pipeline := newTestPipeline(&mockBlobAPI{}, newMockDriveService(), newTestConfig())
+	receipts := NewReceipts()
+
+	group := UploadJob{GroupID: "group-1", Type: "image"}
+	receipts.Saved(group, "token-1", "a.jpg", "folder-1")
+	receipts.Saved(group, "token-2", "b.jpg", "folder-1")
+	receipts.Note(group, "token-2", localize(msgNoteFailed, "c.jpg", describeUploadError(errors.New("boom"))))
+	receipts.Saved(UploadJob{UserID: "user-1", Type: "file"}, "token-3", "notes.txt", "folder-2")
+
+	pipeline.sendReceipts(receipts)
+
+	bot := pipeline.bot.(*mockBot)
+	if len(bot.sentMessages) != 2 {
+		t.Fatalf("sent %d replies, want one per chat: %v", len(bot.sentMessages), bot.sentMessages)
+	}
+	groupReply := bot.sentMessages[0]
+	for _, want := range []string{"Saved 2 files: a.jpg, b.jpg", folderURL("folder-1"), "Could not save c.jpg"} {
+		if !strings.Contains(groupReply, want) {
+			t.Errorf("group reply %q does not mention %q", groupReply, want)
+		}
+	}
+	if !strings.Contains(bot.sentMessages[1], "Saved notes.txt") {
+		t.Errorf("direct reply = %q, want notes.txt", bot.sentMessages[1])
+	}
+}
+
+func TestReceiptListsAreCapped(t *testing.T) {
+	chat := &chatReceipt{}
+	names := make([]string, maxReceiptNames+3)
+	for i := range names {
+		names[i] = fmt.Sprintf("%02d.jpg", i)
+	}
+	chat.saved = []savedFolder{{folderID: "folder-1", names: names}}
+
+	if text := chat.text(localeEnglish); !strings.Contains(text, "and 3 more") {
+		t.Errorf("text() = %q, want the rest summarized", text)
+	}
+}
+
+// expiredTokenBot rejects every reply, as LINE does once a token expired
+type expiredTokenBot struct {
+	mockBot
+}
+
+func (b *expiredTokenBot) ReplyMessage(*messaging_api.ReplyMessageRequest) (*messaging_api.ReplyMessageResponse, error) {
+	return nil, errors.New("invalid reply token")
+}
+
+func TestReceiptsFallBackToPush(t *testing.T) {
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("hello")}, newMockDriveService(), newTestConfig())
+	bot := &expiredTokenBot{}
+	pipeline.bot = bot
+
+	receipts := NewReceipts()
+	job := UploadJob{MessageID: "msg-1", Type: "file", FileName: "notes.txt", GroupID: "group-1"}
+	pipeline.runUpload(context.Background(), job, "expired-token", receipts)
+	pipeline.sendReceipts(receipts)
+
+	if len(bot.pushed) != 1 || !strings.HasPrefix(bot.pushed[0], "group-1: ✅ Saved notes.txt") {
+		t.Errorf("pushed %v, want the receipt pushed to the group", bot.pushed)
+	}
+}
+
+func TestDescribeUploadError(t *testing.T) {
+	if got := describeUploadError(fmt.Errorf("failed to get content: %w", errExternalTooLarge)).text(localeEnglish); got != "the file is too large" {
+		t.Errorf("describeUploadError() = %q", got)
+	}
+	if got := describeUploadError(errors.New("drive quota exceeded")).text(localeEnglish); strings.Contains(got, "quota") {
+		t.Errorf("describeUploadError() leaked details: %q", got)
+	}
+}
+
+func TestReceiptsAreLocalized(t *testing.T) {
+	pipeline := newTestPipeline(&mockBlobAPI{}, newMockDriveService(), newTestConfig())
+	pipeline.settings.groups["group-ja"] = GroupSettings{Language: "ja"}
+	receipts := NewReceipts()
+
+	job := UploadJob{GroupID: "group-ja", Type: "image"}
+	receipts.Saved(job, "token-1", "a.jpg", "folder-1")
+	receipts.Note(job, "token-1", localize(msgNoteFailed, jobName(job), describeUploadError(context.DeadlineExceeded)))
+	pipeline.sendReceipts(receipts)
+
+	bot := pipeline.bot.(*mockBot)
+	want := "✅ a.jpg を保存しました\n" + folderURL("folder-1") + "\n\n❌ 送信された画像 を保存できませんでした: ダウンロードに時間がかかりすぎました。"
+	if len(bot.sentMessages) != 1 || bot.sentMessages[0] != want {
+		t.Errorf("sent %q, want %q", bot.sentMessages, want)
+	}
+}
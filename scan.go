@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// What to do with content over clamd's StreamMaxLength, which clamd refuses
+// to scan
+const (
+	oversizeSkip       = "skip"       // do not archive it and tell the chat why
+	oversizeQuarantine = "quarantine" // archive it in the quarantine folder
+	oversizeUpload     = "upload"     // archive it unscanned
+)
+
+// oversizeThreat marks files quarantined because clamd could not scan them
+const oversizeThreat = "Unscanned: over clamd's size limit"
+
+var errScanTooLarge = errors.New("content exceeds clamd's stream size limit")
+
+func validateOversizePolicy(policy string) error {
+	switch policy {
+	case oversizeSkip, oversizeQuarantine, oversizeUpload:
+		return nil
+	}
+	return fmt.Errorf("invalid CLAMAV_OVERSIZE %q: must be skip, quarantine or upload", policy)
+}
+
+const (
+	// clamChunkSize is the largest INSTREAM chunk sent to clamd
+	clamChunkSize = 64 << 10
+	// clamIOTimeout bounds each read or write on the clamd connection
+	clamIOTimeout = time.Minute
+)
+
+// ClamAVScanner checks content for malware with a clamd daemon, using its
+// INSTREAM command so files never need to be on a disk clamd can read.
+type ClamAVScanner struct {
+	network string
+	address string
+}
+
+// newClamAVScanner parses CLAMAV_ADDRESS: "tcp://host:3310", "host:3310",
+// "unix:///run/clamav/clamd.sock" or a socket path.
+func newClamAVScanner(address string) (*ClamAVScanner, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return &ClamAVScanner{network: "unix", address: strings.TrimPrefix(address, "unix://")}, nil
+	case strings.HasPrefix(address, "/"):
+		return &ClamAVScanner{network: "unix", address: address}, nil
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid CLAMAV_ADDRESS %q: %v", address, err)
+	}
+	return &ClamAVScanner{network: "tcp", address: address}, nil
+}
+
+// Start opens a scan. Content written to it is streamed to clamd as it
+// arrives; Result ends the stream and returns the verdict.
+func (s *ClamAVScanner) Start(ctx context.Context) (*clamScan, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %v", err)
+	}
+
+	scan := &clamScan{conn: conn, w: bufio.NewWriterSize(conn, clamChunkSize+4)}
+	conn.SetDeadline(time.Now().Add(clamIOTimeout))
+	if _, err := scan.w.WriteString("zINSTREAM\x00"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start scan: %v", err)
+	}
+	return scan, nil
+}
+
+// clamScan is one INSTREAM session. Write never fails so a scan cannot
+// interrupt the copy it is teed into; a broken connection shows up in Result.
+type clamScan struct {
+	conn net.Conn
+	w    *bufio.Writer
+	err  error
+}
+
+func (c *clamScan) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && c.err == nil {
+		chunk := p[:min(len(p), clamChunkSize)]
+		p = p[len(chunk):]
+
+		c.conn.SetDeadline(time.Now().Add(clamIOTimeout))
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		if _, c.err = c.w.Write(size[:]); c.err == nil {
+			_, c.err = c.w.Write(chunk)
+		}
+	}
+	return n, nil
+}
+
+// Result finishes the stream and returns the name of the threat found, or ""
+// for clean content. It closes the connection.
+func (c *clamScan) Result() (string, error) {
+	defer c.conn.Close()
+
+	c.conn.SetDeadline(time.Now().Add(clamIOTimeout))
+	if c.err == nil {
+		if _, c.err = c.w.Write([]byte{0, 0, 0, 0}); c.err == nil {
+			c.err = c.w.Flush()
+		}
+	}
+
+	// clamd may answer early, e.g. when the stream is over its size limit,
+	// so the reply is worth reading even after a failed write
+	reply, err := bufio.NewReader(c.conn).ReadString(0)
+	if err != nil && reply == "" {
+		if c.err != nil {
+			// clamd drops the connection once a stream passes its limit
+			return "", fmt.Errorf("%w: connection closed while streaming: %v", errScanTooLarge, c.err)
+		}
+		return "", fmt.Errorf("failed to read clamd reply: %v", err)
+	}
+	return parseClamReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamReply interprets "stream: OK", "stream: <name> FOUND" and
+// "<message> ERROR"
+func parseClamReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	case strings.Contains(result, "size limit exceeded"):
+		return "", errScanTooLarge
+	case strings.HasSuffix(result, " ERROR"):
+		return "", fmt.Errorf("clamd: %s", strings.TrimSuffix(result, " ERROR"))
+	}
+	return "", fmt.Errorf("unexpected clamd reply: %q", reply)
+}
+
+// scanToTempFile spools r to a temporary file while clamd scans it, so
+// nothing is uploaded before the verdict is in. Content too large for clamd
+// is handled as CLAMAV_OVERSIZE says. The caller is responsible for closing
+// and removing the file.
+func (p *Pipeline) scanToTempFile(ctx context.Context, r io.Reader, pattern string) (*os.File, string, error) {
+	scan, err := p.scanner.Start(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	spooled, err := spoolToTempFile(io.TeeReader(r, scan), pattern)
+	if err != nil {
+		scan.conn.Close()
+		return nil, "", err
+	}
+
+	threat, err := scan.Result()
+	if errors.Is(err, errScanTooLarge) {
+		switch p.config.ClamAVOversize {
+		case oversizeUpload:
+			log.Printf("Uploading %s unscanned: %v", spooled.Name(), err)
+			return spooled, "", nil
+		case oversizeQuarantine:
+			return spooled, oversizeThreat, nil
+		}
+	}
+	if err != nil {
+		spooled.Close()
+		os.Remove(spooled.Name())
+		return nil, "", fmt.Errorf("virus scan failed: %w", err)
+	}
+	return spooled, threat, nil
+}
+
+// reportQuarantined tells the admins about an infected file that was moved
+// to the quarantine folder instead of the chat's folder.
+func (p *Pipeline) reportQuarantined(job UploadJob, result *uploadResult) {
+	log.Printf("Quarantined %s (%s): %s", job.MessageID, result.File.Name, result.Threat)
+
+	chat := job.GroupID
+	if chat == "" {
+		chat = "a direct message"
+	}
+	p.notifyAdmins(fmt.Sprintf("🦠 Quarantined %s from %s (sent by %s): %s",
+		result.File.Name, chat, job.UserID, result.Threat))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// fakeClamd answers INSTREAM requests, reporting content that contains
+// "EICAR" as infected and content that contains "OVERSIZE" as over the
+// stream size limit.
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if command, err := r.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var content bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					io.CopyN(&content, r, int64(size))
+				}
+				if strings.Contains(content.String(), "OVERSIZE") {
+					conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+					return
+				}
+				if strings.Contains(content.String(), "EICAR") {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestNewClamAVScanner(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		target  string
+	}{
+		{"tcp://clamav:3310", "tcp", "clamav:3310"},
+		{"clamav:3310", "tcp", "clamav:3310"},
+		{"unix:///run/clamav/clamd.sock", "unix", "/run/clamav/clamd.sock"},
+		{"/run/clamav/clamd.sock", "unix", "/run/clamav/clamd.sock"},
+	}
+	for _, tt := range tests {
+		scanner, err := newClamAVScanner(tt.address)
+		if err != nil {
+			t.Errorf("newClamAVScanner(%q) error: %v", tt.address, err)
+			continue
+		}
+		if scanner.network != tt.network || scanner.address != tt.target {
+			t.Errorf("newClamAVScanner(%q) = %s %s, want %s %s",
+				tt.address, scanner.network, scanner.address, tt.network, tt.target)
+		}
+	}
+
+	if _, err := newClamAVScanner("clamav"); err == nil {
+		t.Error("newClamAVScanner() accepted an address without a port")
+	}
+}
+
+func TestParseClamReply(t *testing.T) {
+	if threat, err := parseClamReply("stream: OK"); threat != "" || err != nil {
+		t.Errorf("clean reply = %q, %v", threat, err)
+	}
+	if threat, err := parseClamReply("stream: Win.Test.EICAR_HDB-1 FOUND"); threat != "Win.Test.EICAR_HDB-1" || err != nil {
+		t.Errorf("infected reply = %q, %v", threat, err)
+	}
+	if _, err := parseClamReply("INSTREAM size limit exceeded. ERROR"); !errors.Is(err, errScanTooLarge) {
+		t.Errorf("size limit reply error = %v, want errScanTooLarge", err)
+	}
+	if _, err := parseClamReply("Can't allocate memory ERROR"); err == nil || errors.Is(err, errScanTooLarge) {
+		t.Errorf("error reply = %v, want a scan failure", err)
+	}
+}
+
+func TestClamAVScannerStreamsLargeContent(t *testing.T) {
+	scanner, _ := newClamAVScanner(fakeClamd(t))
+
+	scan, err := scanner.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	// Several chunks, with the signature in the last one
+	scan.Write(bytes.Repeat([]byte("x"), 3*clamChunkSize))
+	scan.Write([]byte("EICAR"))
+
+	threat, err := scan.Result()
+	if err != nil {
+		t.Fatalf("Result() error: %v", err)
+	}
+	if threat != "Eicar-Test-Signature" {
+		t.Errorf("Result() = %q, want Eicar-Test-Signature", threat)
+	}
+}
+
+func TestProcessUploadQuarantinesInfectedFiles(t *testing.T) {
+	driveService := newMockDriveService()
+	config := newTestConfig()
+	config.QuarantineFolderID = "quarantine-folder"
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("X5O!P%@AP EICAR test file")}, driveService, config)
+	bot := newMockBot()
+	pipeline.bot = bot
+	pipeline.scanner, _ = newClamAVScanner(fakeClamd(t))
+
+	job := UploadJob{MessageID: "file-1", Type: "file", FileName: "invoice.pdf", GroupID: "group-1", UserID: "user-1"}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+
+	stored := driveService.files.created[len(driveService.files.created)-1]
+	if stored.Name != "invoice.pdf" || stored.Parents[0] != "quarantine-folder" {
+		t.Errorf("stored %q in %v, want invoice.pdf in quarantine-folder", stored.Name, stored.Parents)
+	}
+	if stored.AppProperties["threat"] != "Eicar-Test-Signature" {
+		t.Errorf("appProperties = %v, want the threat recorded", stored.AppProperties)
+	}
+
+	if len(bot.multicast) != 1 || !strings.HasPrefix(bot.multicast[0], strings.Join(config.AdminUsers, ",")+": ") {
+		t.Errorf("multicast %v, want one notification to all admins", bot.multicast)
+	}
+	if uploads, _, _ := pipeline.groupCache.GetStats("group-1"); uploads != 0 {
+		t.Errorf("quarantined file counted as %d uploads", uploads)
+	}
+}
+
+func TestProcessUploadScansCleanFiles(t *testing.T) {
+	driveService := newMockDriveService()
+	config := newTestConfig()
+	config.QuarantineFolderID = "quarantine-folder"
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("%PDF-1.4 harmless")}, driveService, config)
+	pipeline.scanner, _ = newClamAVScanner(fakeClamd(t))
+
+	job := UploadJob{MessageID: "file-1", Type: "file", FileName: "invoice.pdf", GroupID: "group-1"}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+	for _, f := range driveService.files.created {
+		if len(f.Parents) > 0 && f.Parents[0] == "quarantine-folder" {
+			t.Errorf("clean file %s was quarantined", f.Name)
+		}
+	}
+	if uploads, _, _ := pipeline.groupCache.GetStats("group-1"); uploads != 1 {
+		t.Errorf("GetStats() uploads = %d, want 1", uploads)
+	}
+}
+
+func TestLoadConfigRequiresQuarantineFolder(t *testing.T) {
+	t.Setenv("LINE_CHANNEL_SECRET", "test-secret")
+	t.Setenv("LINE_CHANNEL_TOKEN", "test-token")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "test-creds.json")
+	t.Setenv("GOOGLE_DRIVE_FOLDER_ID", "test-folder")
+	t.Setenv("CLAMAV_ADDRESS", "tcp://clamav:3310")
+	t.Setenv("QUARANTINE_FOLDER_ID", "")
+
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted CLAMAV_ADDRESS without QUARANTINE_FOLDER_ID")
+	}
+
+	t.Setenv("QUARANTINE_FOLDER_ID", "quarantine-folder")
+	if _, err := loadConfig(); err != nil {
+		t.Errorf("loadConfig() error: %v", err)
+	}
+
+	t.Setenv("CLAMAV_OVERSIZE", "ignore")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted an unknown CLAMAV_OVERSIZE")
+	}
+}
+
+func TestProcessUploadOverClamdLimit(t *testing.T) {
+	tests := []struct {
+		policy     string
+		wantParent string // "" when nothing is stored
+		wantNote   string
+	}{
+		{oversizeSkip, "", "too large to be checked for viruses"},
+		{oversizeQuarantine, "quarantine-folder", "too large to be checked for viruses and was quarantined"},
+		{oversizeUpload, "mock-file-id", "Saved video.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			driveService := newMockDriveService()
+			config := newTestConfig()
+			config.QuarantineFolderID = "quarantine-folder"
+			config.ClamAVOversize = tt.policy
+			pipeline := newTestPipeline(&mockBlobAPI{content: []byte("OVERSIZE movie")}, driveService, config)
+			pipeline.scanner, _ = newClamAVScanner(fakeClamd(t))
+
+			receipts := NewReceipts()
+			job := UploadJob{MessageID: "file-1", Type: "file", FileName: "video.mp4", GroupID: "group-1"}
+			pipeline.runUpload(context.Background(), job, "reply-token", receipts)
+			pipeline.sendReceipts(receipts)
+
+			var stored *drive.File
+			for _, f := range driveService.files.created {
+				if f.Name == "video.mp4" {
+					stored = f
+				}
+			}
+			switch {
+			case tt.wantParent == "" && stored != nil:
+				t.Errorf("stored %+v, want nothing", stored)
+			case tt.wantParent != "" && (stored == nil || stored.Parents[0] != tt.wantParent):
+				t.Errorf("stored %+v, want video.mp4 in %s", stored, tt.wantParent)
+			}
+			bot := pipeline.bot.(*mockBot)
+			if len(bot.sentMessages) != 1 || !strings.Contains(bot.sentMessages[0], tt.wantNote) {
+				t.Errorf("sent %v, want %q", bot.sentMessages, tt.wantNote)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// maxMulticastRecipients is how many users LINE accepts per multicast
+const maxMulticastRecipients = 500
+
+// Variables rather than constants so tests can shorten them
+var (
+	sendAttempts = 4
+	sendBackoff  = time.Second
+)
+
+// RetryingSender retries push and multicast messages that failed because of
+// rate limits, server errors or the network. Each message keeps one
+// X-Line-Retry-Key across attempts so LINE delivers it at most once. Replies
+// are passed through: their token is gone after the first use.
+type RetryingSender struct {
+	MessageSender
+}
+
+func NewRetryingSender(sender MessageSender) *RetryingSender {
+	return &RetryingSender{MessageSender: sender}
+}
+
+func (s *RetryingSender) PushMessage(request *messaging_api.PushMessageRequest, retryKey string) (*messaging_api.PushMessageResponse, error) {
+	var response *messaging_api.PushMessageResponse
+	err := retrySend(retryKey, func(key string) (err error) {
+		response, err = s.MessageSender.PushMessage(request, key)
+		return err
+	})
+	if response == nil && err == nil {
+		response = &messaging_api.PushMessageResponse{}
+	}
+	return response, err
+}
+
+func (s *RetryingSender) Multicast(request *messaging_api.MulticastRequest, retryKey string) (*map[string]interface{}, error) {
+	var response *map[string]interface{}
+	err := retrySend(retryKey, func(key string) (err error) {
+		response, err = s.MessageSender.Multicast(request, key)
+		return err
+	})
+	return response, err
+}
+
+// retrySend calls send until it succeeds, fails for good or runs out of
+// attempts, backing off exponentially in between.
+func retrySend(retryKey string, send func(retryKey string) error) error {
+	if retryKey == "" {
+		retryKey = newRetryKey()
+	}
+
+	backoff := sendBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = send(retryKey)
+		status := sendErrorStatus(err)
+		switch {
+		case err == nil:
+			return nil
+		case status == 409:
+			// An earlier attempt got through after all
+			return nil
+		case attempt >= sendAttempts || !retryableSendError(err, status):
+			return err
+		}
+		log.Printf("Sending failed (attempt %d of %d), retrying in %v: %v", attempt, sendAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+var statusCodePattern = regexp.MustCompile(`unexpected status code: (\d+)`)
+
+// sendErrorStatus extracts the HTTP status from an SDK error, or 0
+func sendErrorStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	match := statusCodePattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0
+	}
+	status, _ := strconv.Atoi(match[1])
+	return status
+}
+
+// retryableSendError reports whether sending again may succeed: when LINE is
+// rate limiting or failing, or the request never got an answer.
+func retryableSendError(err error, status int) bool {
+	if status == 429 || status >= 500 {
+		return true
+	}
+	var netErr net.Error
+	return status == 0 && errors.As(err, &netErr)
+}
+
+// newRetryKey returns a random UUID for the X-Line-Retry-Key header
+func newRetryKey() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// push sends text to a user, group or room without a reply token
+func (p *Pipeline) push(to, text string) error {
+	_, err := p.bot.PushMessage(&messaging_api.PushMessageRequest{
+		To:       to,
+		Messages: []messaging_api.MessageInterface{&messaging_api.TextMessage{Text: text}},
+	}, "")
+	return err
+}
+
+// notifyAdmins sends text to every admin
+func (p *Pipeline) notifyAdmins(text string) {
+	admins := p.config.AdminUsers
+	for start := 0; start < len(admins); start += maxMulticastRecipients {
+		batch := admins[start:min(start+maxMulticastRecipients, len(admins))]
+		_, err := p.bot.Multicast(&messaging_api.MulticastRequest{
+			To:       batch,
+			Messages: []messaging_api.MessageInterface{&messaging_api.TextMessage{Text: text}},
+		}, "")
+		if err != nil {
+			log.Printf("Error notifying admins: %v", err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// flakyBot fails the first pushes and multicasts with the given errors
+type flakyBot struct {
+	mockBot
+	errs      []error
+	retryKeys []string
+}
+
+func (b *flakyBot) next(retryKey string) error {
+	b.retryKeys = append(b.retryKeys, retryKey)
+	if len(b.errs) == 0 {
+		return nil
+	}
+	err := b.errs[0]
+	b.errs = b.errs[1:]
+	return err
+}
+
+func (b *flakyBot) PushMessage(request *messaging_api.PushMessageRequest, retryKey string) (*messaging_api.PushMessageResponse, error) {
+	if err := b.next(retryKey); err != nil {
+		return nil, err
+	}
+	return b.mockBot.PushMessage(request, retryKey)
+}
+
+func (b *flakyBot) Multicast(request *messaging_api.MulticastRequest, retryKey string) (*map[string]interface{}, error) {
+	if err := b.next(retryKey); err != nil {
+		return nil, err
+	}
+	return b.mockBot.Multicast(request, retryKey)
+}
+
+func statusError(code int) error {
+	return fmt.Errorf("unexpected status code: %d, {\"message\":\"test\"}", code)
+}
+
+func withFastRetries(t *testing.T) {
+	backoff := sendBackoff
+	sendBackoff = time.Millisecond
+	t.Cleanup(func() { sendBackoff = backoff })
+}
+
+func pushText(sender MessageSender, to, text string) error {
+	_, err := sender.PushMessage(&messaging_api.PushMessageRequest{
+		To:       to,
+		Messages: []messaging_api.MessageInterface{&messaging_api.TextMessage{Text: text}},
+	}, "")
+	return err
+}
+
+func TestRetryingSenderRetriesWithSameKey(t *testing.T) {
+	withFastRetries(t)
+	bot := &flakyBot{errs: []error{statusError(429), statusError(500)}}
+
+	if err := pushText(NewRetryingSender(bot), "group-1", "hello"); err != nil {
+		t.Fatalf("PushMessage() error: %v", err)
+	}
+	if len(bot.pushed) != 1 || bot.pushed[0] != "group-1: hello" {
+		t.Errorf("pushed %v, want the message once", bot.pushed)
+	}
+	if len(bot.retryKeys) != 3 || bot.retryKeys[0] == "" {
+		t.Fatalf("retry keys = %v, want 3 attempts with a key", bot.retryKeys)
+	}
+	for _, key := range bot.retryKeys {
+		if key != bot.retryKeys[0] {
+			t.Errorf("retry keys = %v, want the same key on every attempt", bot.retryKeys)
+			break
+		}
+	}
+}
+
+func TestRetryingSenderGivesUp(t *testing.T) {
+	withFastRetries(t)
+
+	bot := &flakyBot{errs: []error{statusError(400)}}
+	if err := pushText(NewRetryingSender(bot), "group-1", "hello"); err == nil {
+		t.Error("PushMessage() succeeded after a bad request")
+	}
+	if len(bot.retryKeys) != 1 {
+		t.Errorf("bad request sent %d times, want 1", len(bot.retryKeys))
+	}
+
+	bot = &flakyBot{errs: []error{statusError(503), statusError(503), statusError(503), statusError(503), statusError(503)}}
+	if err := pushText(NewRetryingSender(bot), "group-1", "hello"); err == nil {
+		t.Error("PushMessage() succeeded while LINE was down")
+	}
+	if len(bot.retryKeys) != sendAttempts {
+		t.Errorf("sent %d times, want %d", len(bot.retryKeys), sendAttempts)
+	}
+}
+
+func TestRetryingSenderTreatsConflictAsDelivered(t *testing.T) {
+	withFastRetries(t)
+	bot := &flakyBot{errs: []error{statusError(500), statusError(409)}}
+
+	if err := pushText(NewRetryingSender(bot), "group-1", "hello"); err != nil {
+		t.Errorf("PushMessage() error: %v", err)
+	}
+	if len(bot.retryKeys) != 2 {
+		t.Errorf("sent %d times, want 2", len(bot.retryKeys))
+	}
+}
+
+func TestRetryableSendError(t *testing.T) {
+	netErr := &timeoutError{}
+	if !retryableSendError(netErr, sendErrorStatus(netErr)) {
+		t.Error("network errors should be retried")
+	}
+	if err := errors.New("invalid reply token"); retryableSendError(err, sendErrorStatus(err)) {
+		t.Error("other errors should not be retried")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestNotifyAdminsBatchesMulticasts(t *testing.T) {
+	config := newTestConfig()
+	config.AdminUsers = nil
+	for i := 0; i < maxMulticastRecipients+1; i++ {
+		config.AdminUsers = append(config.AdminUsers, fmt.Sprintf("admin%d", i))
+	}
+	pipeline := newTestPipeline(&mockBlobAPI{}, newMockDriveService(), config)
+	bot := pipeline.bot.(*mockBot)
+
+	pipeline.notifyAdmins("alert")
+	if len(bot.multicast) != 2 {
+		t.Errorf("sent %d multicasts, want 2", len(bot.multicast))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// GroupSettings are options that can differ between chats
+type GroupSettings struct {
+	// Privacy strips GPS and personal EXIF fields from photos before they
+	// are archived
+	Privacy bool `json:"privacy"`
+	// Thumbnails stores a downscaled copy of each photo in a Thumbnails
+	// subfolder and a contact sheet of the day's photos
+	Thumbnails bool `json:"thumbnails"`
+
+	// Media rules; empty values allow everything
+	AllowedTypes   []string `json:"allowedTypes"`   // image, video, audio, file
+	AllowedFormats []string `json:"allowedFormats"` // ".pdf", "application/pdf" or "image/*"
+	MaxSizeMB      int      `json:"maxSizeMB"`
+	// NotifySkipped replies in the chat when media is not archived because
+	// of the rules above
+	NotifySkipped bool `json:"notifySkipped"`
+
+	// Transcript keeps a daily transcript of the chat's text messages in its
+	// folder: "markdown", "jsonl", or "" for none
+	Transcript string `json:"transcript"`
+	// Locations collects the places shared in the chat into a map file in
+	// its folder: "gpx", "kml", or "" or "off" for none. Ignored with Privacy.
+	Locations string `json:"locations"`
+	// KeepUnsent keeps archived media when its message is unsent in LINE,
+	// instead of removing it
+	KeepUnsent bool `json:"keepUnsent"`
+	// Language the bot answers in: "en", "ja", "zh-TW" or "th"; empty
+	// follows the LINE language of whoever sent the command
+	Language string `json:"language"`
+}
+
+// validate rejects settings that cannot be applied
+func (s GroupSettings) validate() error {
+	if err := validateTranscriptFormat(s.Transcript); err != nil {
+		return err
+	}
+	if err := validateLocationsFormat(s.Locations); err != nil {
+		return err
+	}
+	return validateLanguage(s.Language)
+}
+
+// Settings resolves the settings of each chat. Chats without an entry use
+// the defaults; entries only need to list the fields they override.
+//
+// The settings file looks like:
+//
+//	{
+//	  "default": {"privacy": false, "thumbnails": true, "transcript": "markdown"},
+//	  "groups": {
+//	    "C1234...": {"privacy": true}
+//	  }
+//	}
+type Settings struct {
+	defaults GroupSettings
+	groups   map[string]GroupSettings
+}
+
+func NewSettings() *Settings {
+	return &Settings{
+		groups: make(map[string]GroupSettings),
+	}
+}
+
+// settingsFile is the on-disk form of Settings
+type settingsFile struct {
+	Default json.RawMessage            `json:"default"`
+	Groups  map[string]json.RawMessage `json:"groups"`
+}
+
+// loadSettings reads the settings file at path. An empty path yields the
+// built-in defaults for every chat.
+func loadSettings(path string) (*Settings, error) {
+	settings := NewSettings()
+	if path == "" {
+		return settings, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read settings: %v", err)
+	}
+
+	var file settingsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse settings: %v", err)
+	}
+
+	if len(file.Default) > 0 {
+		if err := json.Unmarshal(file.Default, &settings.defaults); err != nil {
+			return nil, fmt.Errorf("failed to parse default settings: %v", err)
+		}
+		if err := settings.defaults.validate(); err != nil {
+			return nil, fmt.Errorf("invalid default settings: %v", err)
+		}
+	}
+
+	// Decode each override on top of its own copy of the defaults
+	for groupID, raw := range file.Groups {
+		var group GroupSettings
+		if len(file.Default) > 0 {
+			json.Unmarshal(file.Default, &group)
+		}
+		if err := json.Unmarshal(raw, &group); err != nil {
+			return nil, fmt.Errorf("failed to parse settings for %s: %v", groupID, err)
+		}
+		if err := group.validate(); err != nil {
+			return nil, fmt.Errorf("invalid settings for %s: %v", groupID, err)
+		}
+		settings.groups[groupID] = group
+	}
+	return settings, nil
+}
+
+// ForGroup returns the settings that apply to a chat
+func (s *Settings) ForGroup(groupID string) GroupSettings {
+	if group, ok := s.groups[groupID]; ok {
+		return group
+	}
+	return s.defaults
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLoadSettings(t *testing.T) {
+	path := t.TempDir() + "/settings.json"
+	writeJSONFile(path, map[string]interface{}{
+		"default": map[string]interface{}{"privacy": true},
+		"groups": map[string]interface{}{
+			"group-public": map[string]interface{}{"privacy": false},
+			"group-other":  map[string]interface{}{},
+		},
+	})
+
+	settings, err := loadSettings(path)
+	if err != nil {
+		t.Fatalf("loadSettings() error: %v", err)
+	}
+	if !settings.ForGroup("unknown").Privacy || !settings.ForGroup("group-other").Privacy {
+		t.Error("Groups without an override should inherit the default")
+	}
+	if settings.ForGroup("group-public").Privacy {
+		t.Error("Override should win over the default")
+	}
+
+	if settings, err := loadSettings(""); err != nil || settings.ForGroup("any").Privacy {
+		t.Errorf("Empty path should give built-in defaults, got %+v, %v", settings, err)
+	}
+}
+
+func TestLoadSettingsRejectsInvalidTranscript(t *testing.T) {
+	path := t.TempDir() + "/settings.json"
+	writeJSONFile(path, map[string]interface{}{
+		"groups": map[string]interface{}{
+			"group-1": map[string]interface{}{"transcript": "html"},
+		},
+	})
+
+	if _, err := loadSettings(path); err == nil {
+		t.Error("loadSettings() accepted an unknown transcript format")
+	}
+}
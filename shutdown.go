@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// UploadJob describes a media message that was accepted from a webhook but
+// has not been archived yet. Jobs still pending at shutdown are written to
+// disk and retried on the next start.
+type UploadJob struct {
+	MessageID string    `json:"messageId"`
+	Type      string    `json:"type"`
+	FileName  string    `json:"fileName,omitempty"`
+	FileSize  int64     `json:"fileSize,omitempty"`
+	UserID    string    `json:"userId,omitempty"`
+	GroupID   string    `json:"groupId,omitempty"`
+	QueuedAt  time.Time `json:"queuedAt"`
+
+	// ContentURL is set for media hosted by an external content provider
+	ContentURL string `json:"contentUrl,omitempty"`
+
+	// Attempts counts retries while LINE is still transcoding the content
+	Attempts int `json:"attempts,omitempty"`
+
+	// Photos sent together share an ImageSet
+	ImageSetID    string `json:"imageSetId,omitempty"`
+	ImageSetIndex int    `json:"imageSetIndex,omitempty"`
+	ImageSetTotal int    `json:"imageSetTotal,omitempty"`
+}
+
+// newUploadJob builds a job for a media message. It returns false for
+// messages that carry no downloadable content.
+func newUploadJob(message webhook.MessageContentInterface, userID, groupID string) (UploadJob, bool) {
+	job := UploadJob{
+		UserID:   userID,
+		GroupID:  groupID,
+		QueuedAt: time.Now(),
+	}
+
+	switch m := message.(type) {
+	case webhook.ImageMessageContent:
+		job.MessageID, job.Type = m.Id, "image"
+		if m.ImageSet != nil {
+			job.ImageSetID = m.ImageSet.Id
+			job.ImageSetIndex = int(m.ImageSet.Index)
+			job.ImageSetTotal = int(m.ImageSet.Total)
+		}
+	case webhook.VideoMessageContent:
+		job.MessageID, job.Type = m.Id, "video"
+	case webhook.AudioMessageContent:
+		job.MessageID, job.Type = m.Id, "audio"
+	case webhook.FileMessageContent:
+		job.MessageID, job.Type, job.FileName, job.FileSize = m.Id, "file", m.FileName, int64(m.FileSize)
+	default:
+		return UploadJob{}, false
+	}
+	job.ContentURL = externalContentURL(message)
+	return job, true
+}
+
+// Message rebuilds the webhook content the job was created from.
+func (j UploadJob) Message() webhook.MessageContentInterface {
+	var provider *webhook.ContentProvider
+	if j.ContentURL != "" {
+		provider = &webhook.ContentProvider{
+			Type:               webhook.ContentProviderTYPE_EXTERNAL,
+			OriginalContentUrl: j.ContentURL,
+		}
+	}
+
+	switch j.Type {
+	case "image":
+		image := webhook.ImageMessageContent{Id: j.MessageID, ContentProvider: provider}
+		if j.ImageSetID != "" {
+			image.ImageSet = &webhook.ImageSet{
+				Id:    j.ImageSetID,
+				Index: int32(j.ImageSetIndex),
+				Total: int32(j.ImageSetTotal),
+			}
+		}
+		return image
+	case "video":
+		return webhook.VideoMessageContent{Id: j.MessageID, ContentProvider: provider}
+	case "audio":
+		return webhook.AudioMessageContent{Id: j.MessageID, ContentProvider: provider}
+	case "file":
+		return webhook.FileMessageContent{Id: j.MessageID, FileName: j.FileName, FileSize: int32(j.FileSize)}
+	default:
+		return nil
+	}
+}
+
+// UploadTracker keeps track of accepted upload jobs so that a shutdown can
+// wait for them to finish and persist the ones that did not.
+type UploadTracker struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	stopping chan struct{}        // closed when draining starts
+	pending  map[string]UploadJob // messageID -> job
+	requeued map[string]bool      // jobs handed to a retry, kept by Done
+}
+
+func NewUploadTracker() *UploadTracker {
+	return &UploadTracker{
+		stopping: make(chan struct{}),
+		pending:  make(map[string]UploadJob),
+		requeued: make(map[string]bool),
+	}
+}
+
+// Accept registers a batch of jobs that is about to be processed. It returns
+// false once the tracker is draining, in which case nothing is recorded and
+// the caller must not start any work.
+func (t *UploadTracker) Accept(jobs []UploadJob) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return false
+	}
+
+	for _, job := range jobs {
+		t.pending[job.MessageID] = job
+	}
+	t.wg.Add(1)
+	return true
+}
+
+// Requeue hands a job over to a retry that runs as a batch of its own; the
+// retry must call Done with the job when it ends. Until the job is finished,
+// Done leaves it pending. It returns false while draining, in which case no
+// retry may start and the job is reported by Drain.
+func (t *UploadTracker) Requeue(job UploadJob) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[job.MessageID] = job
+	t.requeued[job.MessageID] = true
+	if t.draining {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+// Finish marks a single job as handled, whether or not the upload succeeded.
+func (t *UploadTracker) Finish(messageID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, messageID)
+	delete(t.requeued, messageID)
+}
+
+// Done releases a batch registered with Accept. Jobs of the batch that were
+// never finished (e.g. skipped for permissions) are dropped as well, unless
+// they were requeued.
+func (t *UploadTracker) Done(jobs []UploadJob) {
+	t.mu.Lock()
+	for _, job := range jobs {
+		if !t.requeued[job.MessageID] {
+			delete(t.pending, job.MessageID)
+		}
+	}
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// Stopping is closed once Drain is called, so waiting retries can give up
+// early and leave their jobs for the next start.
+func (t *UploadTracker) Stopping() <-chan struct{} {
+	return t.stopping
+}
+
+// Drain stops accepting new batches and waits for the accepted ones until
+// ctx is done. It returns the jobs that are still pending.
+func (t *UploadTracker) Drain(ctx context.Context) []UploadJob {
+	t.mu.Lock()
+	if !t.draining {
+		t.draining = true
+		close(t.stopping)
+	}
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var remaining []UploadJob
+	for _, job := range t.pending {
+		remaining = append(remaining, job)
+	}
+	return remaining
+}
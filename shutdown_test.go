@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+func TestNewUploadJob(t *testing.T) {
+	tests := []struct {
+		name    string
+		message webhook.MessageContentInterface
+		wantOK  bool
+		want    UploadJob
+	}{
+		{
+			name:    "Image message",
+			message: webhook.ImageMessageContent{Id: "img-1"},
+			wantOK:  true,
+			want:    UploadJob{MessageID: "img-1", Type: "image"},
+		},
+		{
+			name: "Image set member",
+			message: webhook.ImageMessageContent{Id: "img-2",
+				ImageSet: &webhook.ImageSet{Id: "set-1", Index: 2, Total: 3}},
+			wantOK: true,
+			want: UploadJob{MessageID: "img-2", Type: "image",
+				ImageSetID: "set-1", ImageSetIndex: 2, ImageSetTotal: 3},
+		},
+		{
+			name: "External video",
+			message: webhook.VideoMessageContent{Id: "vid-1", ContentProvider: &webhook.ContentProvider{
+				Type: webhook.ContentProviderTYPE_EXTERNAL, OriginalContentUrl: "https://example.com/v.mp4"}},
+			wantOK: true,
+			want:   UploadJob{MessageID: "vid-1", Type: "video", ContentURL: "https://example.com/v.mp4"},
+		},
+		{
+			name:    "File message",
+			message: webhook.FileMessageContent{Id: "file-1", FileName: "doc.pdf"},
+			wantOK:  true,
+			want:    UploadJob{MessageID: "file-1", Type: "file", FileName: "doc.pdf"},
+		},
+		{
+			name:    "Text message",
+			message: webhook.TextMessageContent{Id: "text-1", Text: "hi"},
+			wantOK:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job, ok := newUploadJob(tt.message, "user-1", "group-1")
+			if ok != tt.wantOK {
+				t.Fatalf("newUploadJob() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if job.MessageID != tt.want.MessageID || job.Type != tt.want.Type || job.FileName != tt.want.FileName ||
+				job.ContentURL != tt.want.ContentURL {
+				t.Errorf("newUploadJob() = %+v, want %+v", job, tt.want)
+			}
+			if job.ImageSetID != tt.want.ImageSetID || job.ImageSetIndex != tt.want.ImageSetIndex ||
+				job.ImageSetTotal != tt.want.ImageSetTotal {
+				t.Errorf("newUploadJob() image set = %+v, want %+v", job, tt.want)
+			}
+			if job.UserID != "user-1" || job.GroupID != "group-1" {
+				t.Errorf("newUploadJob() source = %s/%s, want user-1/group-1", job.UserID, job.GroupID)
+			}
+
+			// The rebuilt message must produce the same job again
+			again, _ := newUploadJob(job.Message(), job.UserID, job.GroupID)
+			again.QueuedAt = job.QueuedAt
+			if again != job {
+				t.Errorf("Message() round trip = %+v, want %+v", again, job)
+			}
+		})
+	}
+}
+
+func TestUploadTrackerDrain(t *testing.T) {
+	tracker := NewUploadTracker()
+
+	finished := []UploadJob{{MessageID: "done-1", Type: "image"}}
+	if !tracker.Accept(finished) {
+		t.Fatal("Accept should succeed before draining")
+	}
+	tracker.Finish("done-1")
+	tracker.Done(finished)
+
+	stuck := []UploadJob{{MessageID: "stuck-1", Type: "video"}, {MessageID: "stuck-2", Type: "image"}}
+	if !tracker.Accept(stuck) {
+		t.Fatal("Accept should succeed before draining")
+	}
+	tracker.Finish("stuck-2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	pending := tracker.Drain(ctx)
+	if len(pending) != 1 || pending[0].MessageID != "stuck-1" {
+		t.Errorf("Drain() = %+v, want only stuck-1", pending)
+	}
+
+	if tracker.Accept([]UploadJob{{MessageID: "late", Type: "image"}}) {
+		t.Error("Accept should fail while draining")
+	}
+}
+
+func TestUploadTrackerDrainWaitsForBatches(t *testing.T) {
+	tracker := NewUploadTracker()
+	jobs := []UploadJob{{MessageID: "slow-1", Type: "image"}}
+	tracker.Accept(jobs)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		tracker.Finish("slow-1")
+		tracker.Done(jobs)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if pending := tracker.Drain(ctx); len(pending) != 0 {
+		t.Errorf("Drain() = %+v, want no pending jobs", pending)
+	}
+	if ctx.Err() != nil {
+		t.Error("Drain should return as soon as batches are done")
+	}
+}
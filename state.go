@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File names used inside Config.StateDir
+const (
+	messageCacheFile   = "message-cache.json"
+	groupCacheFile     = "group-cache.json"
+	pendingUploadsFile = "pending-uploads.json"
+)
+
+// writeJSONFile atomically replaces path with the JSON encoding of v.
+func writeJSONFile(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readJSONFile decodes path into v. A missing file is not an error and
+// leaves v untouched.
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (c *MessageCache) Save(path string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return writeJSONFile(path, c.processed)
+}
+
+func (c *MessageCache) Load(path string) error {
+	processed := make(map[string]time.Time)
+	if err := readJSONFile(path, &processed); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, t := range processed {
+		if time.Since(t) <= 24*time.Hour {
+			c.processed[id] = t
+		}
+	}
+	return nil
+}
+
+// groupStatsSnapshot is the on-disk form of GroupStats
+type groupStatsSnapshot struct {
+	TotalUploads int                  `json:"totalUploads"`
+	LastUpload   time.Time            `json:"lastUpload"`
+	RecentFiles  []FileInfo           `json:"recentFiles"`
+	ImageSets    map[string]time.Time `json:"imageSets,omitempty"`
+	ArchivedAt   time.Time            `json:"archivedAt"`
+	FolderID     string               `json:"folderId,omitempty"`
+	Daily        map[string]int       `json:"daily,omitempty"`
+}
+
+func (c *GroupCache) Save(path string) error {
+	c.mu.RLock()
+	snapshot := make(map[string]groupStatsSnapshot, len(c.stats))
+	for groupID, stats := range c.stats {
+		stats.mu.RLock()
+		snapshot[groupID] = groupStatsSnapshot{
+			TotalUploads: stats.TotalUploads,
+			LastUpload:   stats.LastUpload,
+			RecentFiles:  stats.RecentFiles,
+			ImageSets:    maps.Clone(stats.ImageSets),
+			ArchivedAt:   stats.ArchivedAt,
+			FolderID:     stats.FolderID,
+			Daily:        maps.Clone(stats.Daily),
+		}
+		stats.mu.RUnlock()
+	}
+	c.mu.RUnlock()
+
+	return writeJSONFile(path, snapshot)
+}
+
+func (c *GroupCache) Load(path string) error {
+	snapshot := make(map[string]groupStatsSnapshot)
+	if err := readJSONFile(path, &snapshot); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for groupID, s := range snapshot {
+		c.stats[groupID] = &GroupStats{
+			TotalUploads: s.TotalUploads,
+			LastUpload:   s.LastUpload,
+			RecentFiles:  s.RecentFiles,
+			ImageSets:    s.ImageSets,
+			ArchivedAt:   s.ArchivedAt,
+			FolderID:     s.FolderID,
+			Daily:        s.Daily,
+		}
+	}
+	return nil
+}
+
+func savePendingUploads(path string, jobs []UploadJob) error {
+	if len(jobs) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return writeJSONFile(path, jobs)
+}
+
+// loadPendingUploads returns the jobs left over by the previous run and
+// removes the file so they are only retried once.
+func loadPendingUploads(path string) ([]UploadJob, error) {
+	var jobs []UploadJob
+	if err := readJSONFile(path, &jobs); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return jobs, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachePersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	messageCache := NewMessageCache()
+	messageCache.MarkProcessed("msg-1")
+	messageCache.processed["expired"] = time.Now().Add(-25 * time.Hour)
+	if err := messageCache.Save(filepath.Join(dir, messageCacheFile)); err != nil {
+		t.Fatalf("MessageCache.Save() error: %v", err)
+	}
+
+	groupCache := NewGroupCache()
+	groupCache.AddUploadedFile("group-1", "a.jpg", "")
+	groupCache.AddUploadedFile("group-1", "b.jpg", "")
+	if err := groupCache.Save(filepath.Join(dir, groupCacheFile)); err != nil {
+		t.Fatalf("GroupCache.Save() error: %v", err)
+	}
+
+	loadedMessages := NewMessageCache()
+	if err := loadedMessages.Load(filepath.Join(dir, messageCacheFile)); err != nil {
+		t.Fatalf("MessageCache.Load() error: %v", err)
+	}
+	if !loadedMessages.IsProcessed("msg-1") {
+		t.Error("msg-1 should be processed after load")
+	}
+	if loadedMessages.IsProcessed("expired") {
+		t.Error("Expired entries should not be loaded")
+	}
+
+	loadedGroups := NewGroupCache()
+	if err := loadedGroups.Load(filepath.Join(dir, groupCacheFile)); err != nil {
+		t.Fatalf("GroupCache.Load() error: %v", err)
+	}
+	uploads, _, files := loadedGroups.GetStats("group-1")
+	if uploads != 2 || len(files) != 2 || files[0].Name != "b.jpg" {
+		t.Errorf("Loaded stats = %d, %+v", uploads, files)
+	}
+
+	// Loading from a missing directory is not an error
+	if err := NewGroupCache().Load(filepath.Join(dir, "missing", groupCacheFile)); err != nil {
+		t.Errorf("Load() of missing file returned error: %v", err)
+	}
+}
+
+func TestPendingUploadsPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), pendingUploadsFile)
+	jobs := []UploadJob{{MessageID: "m1", Type: "file", FileName: "a.pdf", GroupID: "g1"}}
+
+	if err := savePendingUploads(path, jobs); err != nil {
+		t.Fatalf("savePendingUploads() error: %v", err)
+	}
+
+	loaded, err := loadPendingUploads(path)
+	if err != nil {
+		t.Fatalf("loadPendingUploads() error: %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].MessageID != "m1" || loaded[0].FileName != "a.pdf" {
+		t.Errorf("loadPendingUploads() = %+v", loaded)
+	}
+
+	// Jobs are only retried once
+	loaded, err = loadPendingUploads(path)
+	if err != nil || len(loaded) != 0 {
+		t.Errorf("Second loadPendingUploads() = %+v, %v; want none", loaded, err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// maxAltTextLength is the longest alt text LINE accepts for a Flex Message
+const maxAltTextLength = 400
+
+// statsSummary is what /stats reports about a chat, or about every chat
+type statsSummary struct {
+	Title       string
+	Uploads     int
+	LastUpload  time.Time
+	RecentFiles []FileInfo
+	FolderID    string // chat folder for the card's button; "" leaves it out
+	// Period is the argument of "/stats 30d", and PeriodUploads the uploads
+	// counted in it
+	Period        string
+	PeriodUploads int
+}
+
+// text renders the summary as plain text
+func (s statsSummary) text(locale string) string {
+	msg := fmt.Sprintf("%s\n%s: %d", s.Title, tr(locale, msgTotalUploads), s.Uploads)
+	if s.Period != "" {
+		msg += fmt.Sprintf("\n%s: %d", fmt.Sprintf(tr(locale, msgUploadsInPeriod), s.Period), s.PeriodUploads)
+	}
+	msg += fmt.Sprintf("\n%s: %s", tr(locale, msgLastUpload), formatDateTime(locale, s.LastUpload))
+
+	if len(s.RecentFiles) == 0 {
+		return msg + "\n\n" + tr(locale, msgNoRecentUploads)
+	}
+	msg += "\n\n" + tr(locale, msgRecentUploads) + ":"
+	for _, file := range s.RecentFiles {
+		msg += fmt.Sprintf("\n%s - %s", formatDateTime(locale, file.Timestamp), file.Name)
+	}
+	return msg
+}
+
+// statsCard renders the summary as a Flex Message in locale. Its text form
+// is shown by clients that cannot render Flex and in notifications.
+func statsCard(locale string, s statsSummary) *messaging_api.FlexMessage {
+	last := "—"
+	if !s.LastUpload.IsZero() {
+		last = formatDateTime(locale, s.LastUpload)
+	}
+
+	body := []messaging_api.FlexComponentInterface{
+		statsRow(tr(locale, msgTotalUploads), strconv.Itoa(s.Uploads)),
+	}
+	if s.Period != "" {
+		body = append(body, statsRow(fmt.Sprintf(tr(locale, msgUploadsInPeriod), s.Period), strconv.Itoa(s.PeriodUploads)))
+	}
+	body = append(body,
+		statsRow(tr(locale, msgLastUpload), last),
+		&messaging_api.FlexSeparator{Margin: "lg"},
+	)
+	if len(s.RecentFiles) == 0 {
+		body = append(body, &messaging_api.FlexText{Text: tr(locale, msgNoRecentUploads), Size: "sm", Color: "#999999", Margin: "lg", Wrap: true})
+	} else {
+		body = append(body, &messaging_api.FlexText{Text: tr(locale, msgRecentUploads), Size: "sm", Weight: messaging_api.FlexTextWEIGHT_BOLD, Margin: "lg"})
+		for _, file := range s.RecentFiles {
+			body = append(body, recentFileRow(locale, file))
+		}
+	}
+
+	bubble := &messaging_api.FlexBubble{
+		Header: &messaging_api.FlexBox{
+			Layout: messaging_api.FlexBoxLAYOUT_VERTICAL,
+			Contents: []messaging_api.FlexComponentInterface{
+				&messaging_api.FlexText{Text: s.Title, Weight: messaging_api.FlexTextWEIGHT_BOLD, Size: "lg"},
+			},
+		},
+		Body: &messaging_api.FlexBox{
+			Layout:   messaging_api.FlexBoxLAYOUT_VERTICAL,
+			Spacing:  "sm",
+			Contents: body,
+		},
+	}
+	if s.FolderID != "" {
+		bubble.Footer = &messaging_api.FlexBox{
+			Layout: messaging_api.FlexBoxLAYOUT_VERTICAL,
+			Contents: []messaging_api.FlexComponentInterface{
+				&messaging_api.FlexButton{
+					Style:  messaging_api.FlexButtonSTYLE_PRIMARY,
+					Action: &messaging_api.UriAction{Label: tr(locale, msgOpenFolder), Uri: folderURL(s.FolderID)},
+				},
+			},
+		}
+	}
+
+	altText := []rune(s.text(locale))
+	if len(altText) > maxAltTextLength {
+		altText = append(altText[:maxAltTextLength-1], '…')
+	}
+	return &messaging_api.FlexMessage{AltText: string(altText), Contents: bubble}
+}
+
+// statsRow is a label with its value on the right
+func statsRow(label, value string) *messaging_api.FlexBox {
+	return &messaging_api.FlexBox{
+		Layout: messaging_api.FlexBoxLAYOUT_HORIZONTAL,
+		Contents: []messaging_api.FlexComponentInterface{
+			&messaging_api.FlexText{Text: label, Size: "sm", Color: "#555555", Flex: 1},
+			&messaging_api.FlexText{Text: value, Size: "sm", Align: messaging_api.FlexTextALIGN_END, Flex: 1},
+		},
+	}
+}
+
+// recentFileRow lists an upload, linked to Drive when its link is known
+func recentFileRow(locale string, file FileInfo) *messaging_api.FlexBox {
+	name := &messaging_api.FlexText{Text: file.Name, Size: "sm", Flex: 3}
+	if file.URL != "" {
+		name.Color = "#1A73E8"
+		name.Decoration = messaging_api.FlexTextDECORATION_UNDERLINE
+		name.Action = &messaging_api.UriAction{Label: "Open", Uri: file.URL}
+	}
+	return &messaging_api.FlexBox{
+		Layout: messaging_api.FlexBoxLAYOUT_HORIZONTAL,
+		Contents: []messaging_api.FlexComponentInterface{
+			name,
+			&messaging_api.FlexText{Text: formatShortDateTime(locale, file.Timestamp), Size: "xs", Color: "#999999", Align: messaging_api.FlexTextALIGN_END, Flex: 2},
+		},
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+func TestStatsCardLinksUploads(t *testing.T) {
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("hello")}, newMockDriveService(), newTestConfig())
+	bot := pipeline.bot.(*mockBot)
+
+	job := UploadJob{MessageID: "msg-1", Type: "file", FileName: "notes.txt", GroupID: "group-1"}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+	handleCommand(bot, "/stats", "", "group-1", "reply-token", pipeline.groupCache, localeEnglish, false)
+
+	if len(bot.flex) != 1 {
+		t.Fatalf("sent %d Flex Messages, want 1", len(bot.flex))
+	}
+	card := bot.flex[0]
+	if !strings.Contains(card.AltText, "Total uploads: 1") || !strings.Contains(card.AltText, "notes.txt") {
+		t.Errorf("alt text = %q, want the text version of the stats", card.AltText)
+	}
+
+	data, err := json.Marshal(&messaging_api.ReplyMessageRequest{ReplyToken: "t", Messages: []messaging_api.MessageInterface{card}})
+	if err != nil {
+		t.Fatalf("marshal card: %v", err)
+	}
+	for _, want := range []string{
+		`"type":"flex"`,
+		`"type":"bubble"`,
+		"https://drive.google.com/file/d/mock-file-id/view",
+		`"label":"Open folder"`,
+		folderURL("mock-file-id"),
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("card JSON does not contain %s: %s", want, data)
+		}
+	}
+}
+
+func TestStatsCardWithoutFolder(t *testing.T) {
+	var files []FileInfo
+	for i := 0; i < 20; i++ {
+		files = append(files, FileInfo{Name: strings.Repeat("x", 40), Timestamp: time.Now()})
+	}
+	card := statsCard(localeEnglish, statsSummary{Title: "📊 Upload Statistics", RecentFiles: files})
+	if card.Contents.(*messaging_api.FlexBubble).Footer != nil {
+		t.Error("card has a folder button without a folder")
+	}
+	if n := len([]rune(card.AltText)); n != maxAltTextLength {
+		t.Errorf("alt text is %d characters, want %d", n, maxAltTextLength)
+	}
+}
+
+// flexRejectingBot refuses Flex Messages, like a bad card would be refused
+type flexRejectingBot struct {
+	mockBot
+}
+
+func (b *flexRejectingBot) ReplyMessage(request *messaging_api.ReplyMessageRequest) (*messaging_api.ReplyMessageResponse, error) {
+	if _, ok := request.Messages[0].(*messaging_api.FlexMessage); ok {
+		return nil, errors.New("unexpected status code: 400, invalid flex")
+	}
+	return b.mockBot.ReplyMessage(request)
+}
+
+func TestStatsFallsBackToText(t *testing.T) {
+	bot := &flexRejectingBot{}
+	groupCache := NewGroupCache()
+	groupCache.AddUploadedFile("group-1", "a.jpg", "")
+
+	handleCommand(bot, "/stats", "", "group-1", "reply-token", groupCache, localeEnglish, false)
+	if len(bot.sentMessages) != 1 || !strings.HasPrefix(bot.sentMessages[0], "📊 Group Statistics") {
+		t.Errorf("sent %v, want the stats as text", bot.sentMessages)
+	}
+}
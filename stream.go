@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// uploadStream passes content through to the storage backend while counting
+// bytes and computing its SHA-256, so nothing has to touch the disk.
+type uploadStream struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func newUploadStream(r io.Reader) *uploadStream {
+	return &uploadStream{r: r, hash: sha256.New()}
+}
+
+func (s *uploadStream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.hash.Write(p[:n])
+		s.n += int64(n)
+	}
+	return n, err
+}
+
+// Size returns the number of bytes read so far
+func (s *uploadStream) Size() int64 {
+	return s.n
+}
+
+// Sum returns the hex encoded SHA-256 of the bytes read so far
+func (s *uploadStream) Sum() string {
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// seekableMediaBackend is implemented by FilesService backends that can only
+// upload from seekable input (e.g. to send Content-Length or rewind on retry).
+type seekableMediaBackend interface {
+	NeedsSeekableMedia() bool
+}
+
+func needsSeekableMedia(files FilesService) bool {
+	backend, ok := files.(seekableMediaBackend)
+	return ok && backend.NeedsSeekableMedia()
+}
+
+// spoolToTempFile copies r into a temporary file and returns it rewound to
+// the start. The caller is responsible for closing and removing the file.
+func spoolToTempFile(r io.Reader, pattern string) (*os.File, error) {
+	tmpFile, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, fmt.Errorf("failed to copy content: %v", err)
+	}
+
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, fmt.Errorf("failed to rewind temp file: %v", err)
+	}
+	return tmpFile, nil
+}
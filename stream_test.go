@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestUploadStream(t *testing.T) {
+	content := strings.Repeat("line photo ", 1000)
+	stream := newUploadStream(strings.NewReader(content))
+
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, stream); err != nil {
+		t.Fatalf("io.Copy() error: %v", err)
+	}
+
+	if out.String() != content {
+		t.Error("Stream should pass content through unchanged")
+	}
+	if stream.Size() != int64(len(content)) {
+		t.Errorf("Size() = %d, want %d", stream.Size(), len(content))
+	}
+	sum := sha256.Sum256([]byte(content))
+	if stream.Sum() != hex.EncodeToString(sum[:]) {
+		t.Errorf("Sum() = %s, want %s", stream.Sum(), hex.EncodeToString(sum[:]))
+	}
+}
+
+// seekableFilesService only accepts seekable media
+type seekableFilesService struct {
+	mockFilesService
+	sawSeeker bool
+}
+
+func (s *seekableFilesService) NeedsSeekableMedia() bool {
+	return true
+}
+
+func (s *seekableFilesService) CreateFile(file *drive.File, media io.Reader) (*drive.File, error) {
+	_, s.sawSeeker = media.(io.Seeker)
+	return s.mockFilesService.CreateFile(file, media)
+}
+
+type seekableDriveService struct {
+	files *seekableFilesService
+}
+
+func (d *seekableDriveService) Files() FilesService {
+	return d.files
+}
+
+func TestHandleFileStreaming(t *testing.T) {
+	mockContent := []byte("streamed content")
+
+	config := &Config{LineChannelToken: "mock-token", GoogleDriveFolderID: "mock-folder"}
+	message := webhook.ImageMessageContent{Id: "img-1"}
+
+	t.Run("Streaming backend", func(t *testing.T) {
+		driveService := newMockDriveService()
+		pipeline := newTestPipeline(&mockBlobAPI{content: mockContent}, driveService, config)
+		if _, err := pipeline.handleFile(context.Background(), message, "img-1", ".jpg", "", config.GoogleDriveFolderID, GroupSettings{}, chatNames{}); err != nil {
+			t.Fatalf("handleFile() error: %v", err)
+		}
+		if len(driveService.files.uploaded) != 1 || !bytes.Equal(driveService.files.uploaded[0], mockContent) {
+			t.Errorf("Uploaded content = %q, want %q", driveService.files.uploaded, mockContent)
+		}
+	})
+
+	t.Run("Seekable backend", func(t *testing.T) {
+		driveService := &seekableDriveService{files: &seekableFilesService{}}
+		pipeline := newTestPipeline(&mockBlobAPI{content: mockContent}, driveService, config)
+		if _, err := pipeline.handleFile(context.Background(), message, "img-1", ".jpg", "", config.GoogleDriveFolderID, GroupSettings{}, chatNames{}); err != nil {
+			t.Fatalf("handleFile() error: %v", err)
+		}
+		if !driveService.files.sawSeeker {
+			t.Error("Backend needing seekable media should receive a spooled file")
+		}
+		if len(driveService.files.uploaded) != 1 || !bytes.Equal(driveService.files.uploaded[0], mockContent) {
+			t.Errorf("Uploaded content = %q, want %q", driveService.files.uploaded, mockContent)
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	_ "image/png" // registers the PNG decoder
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// thumbnailFolderName is the subfolder that holds thumbnails and contact sheets
+const thumbnailFolderName = "Thumbnails"
+
+const (
+	// maxThumbnailSource caps how much of a photo is kept in memory to
+	// render its thumbnail; larger photos are archived without one
+	maxThumbnailSource = 32 << 20
+	// maxThumbnailPixels guards against images that decode to huge bitmaps
+	maxThumbnailPixels = 100_000_000
+	thumbnailQuality   = 85
+	tagOrientation     = 0x0112
+)
+
+// supportsThumbnails reports whether makeThumbnail can decode the type
+func supportsThumbnails(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// captureBuffer keeps a copy of what is written to it, up to limit bytes.
+// Writes never fail so it can sit behind an io.TeeReader.
+type captureBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func newCaptureBuffer(limit int) *captureBuffer {
+	return &captureBuffer{limit: limit}
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if b.buf.Len()+len(p) > b.limit {
+		b.overflow = true
+		b.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// Bytes returns the captured content, or nil when it exceeded the limit
+func (b *captureBuffer) Bytes() []byte {
+	if b.overflow {
+		return nil
+	}
+	return b.buf.Bytes()
+}
+
+// makeThumbnail decodes a photo and scales it to fit in a maxSize square,
+// turning it upright according to its EXIF orientation.
+func makeThumbnail(data []byte, maxSize int) (*image.RGBA, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %v", err)
+	}
+	if cfg.Width*cfg.Height > maxThumbnailPixels {
+		return nil, fmt.Errorf("image too large for a thumbnail: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	thumb := resizeToFit(img, maxSize)
+	if tiff := jpegExifData(data); tiff != nil {
+		thumb = applyOrientation(thumb, exifOrientation(tiff))
+	}
+	return thumb, nil
+}
+
+// resizeToFit scales src down to fit in a maxSize square, keeping its aspect
+// ratio. Each target pixel averages a grid of samples from the area it covers,
+// and transparent areas are flattened onto white.
+func resizeToFit(src image.Image, maxSize int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	w, h := sw, sh
+	if w > maxSize || h > maxSize {
+		if w >= h {
+			w, h = maxSize, max(1, h*maxSize/w)
+		} else {
+			w, h = max(1, w*maxSize/h), maxSize
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		ny := min(4, y1-y0)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			nx := min(4, x1-x0)
+
+			var r, g, bl, a uint64
+			for j := 0; j < ny; j++ {
+				sy := b.Min.Y + y0 + (2*j+1)*(y1-y0)/(2*ny)
+				for i := 0; i < nx; i++ {
+					sx := b.Min.X + x0 + (2*i+1)*(x1-x0)/(2*nx)
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+				}
+			}
+
+			n := uint64(nx * ny)
+			white := 0xffff - a/n // colors are premultiplied
+			off := dst.PixOffset(x, y)
+			dst.Pix[off+0] = uint8((r/n + white) >> 8)
+			dst.Pix[off+1] = uint8((g/n + white) >> 8)
+			dst.Pix[off+2] = uint8((bl/n + white) >> 8)
+			dst.Pix[off+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// exifOrientation returns the orientation tag (1-8) of a TIFF block, or 1
+func exifOrientation(data []byte) int {
+	r, ok := newTIFFReader(data)
+	if !ok {
+		return 1
+	}
+	ifd0Offset, _ := r.uint32At(4)
+	entry, ok := r.readIFD(int(ifd0Offset))[tagOrientation]
+	if !ok {
+		return 1
+	}
+	value, ok := r.uint16At(entry.valueOffset)
+	if !ok || value < 1 || value > 8 {
+		return 1
+	}
+	return int(value)
+}
+
+// applyOrientation flips and rotates img so that it displays upright
+func applyOrientation(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flip horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotate 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // flip vertically
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], img.Pix[img.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// thumbnailName derives the thumbnail file name from the archived file
+func thumbnailName(fileName string) string {
+	return strings.TrimSuffix(fileName, path.Ext(fileName)) + "-thumb.jpg"
+}
+
+// createThumbnail uploads a thumbnail of the photo archived from messageID
+// into the Thumbnails subfolder next to it and adds it to the chat's contact
+// sheet for the day. The thumbnail is tagged with the message so unsending
+// removes it too.
+func (p *Pipeline) createThumbnail(result *uploadResult, chatFolderID, messageID string) error {
+	thumb, err := makeThumbnail(result.Content, p.config.ThumbnailSize)
+	if err != nil {
+		return err
+	}
+	data, err := encodeJPEG(thumb)
+	if err != nil {
+		return fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+
+	folderID, err := p.folder(thumbnailFolderName, result.FolderID)
+	if err != nil {
+		return err
+	}
+	thumbFile := &drive.File{
+		Name:     thumbnailName(result.File.Name),
+		MimeType: "image/jpeg",
+		Parents:  []string{folderID},
+		AppProperties: map[string]string{
+			lineMessageIDProperty: messageID,
+		},
+	}
+	if _, err := p.drive.Files().CreateFile(thumbFile, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to upload thumbnail: %v", err)
+	}
+	log.Printf("Thumbnail uploaded: %s", thumbFile.Name)
+
+	if p.contactSheets != nil {
+		if err := p.contactSheets.Add(chatFolderID, messageID, time.Now(), data); err != nil {
+			return fmt.Errorf("failed to queue thumbnail for contact sheet: %v", err)
+		}
+	}
+	return nil
+}
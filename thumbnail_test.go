@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResizeToFit(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		want          image.Point
+	}{
+		{"landscape", 400, 200, image.Pt(100, 50)},
+		{"portrait", 100, 300, image.Pt(33, 100)},
+		{"already small", 40, 30, image.Pt(40, 30)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewRGBA(image.Rect(0, 0, tt.width, tt.height))
+			got := resizeToFit(src, 100).Bounds().Size()
+			if got != tt.want {
+				t.Errorf("resizeToFit() size = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("transparency becomes white", func(t *testing.T) {
+		src := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+		got := resizeToFit(src, 5).RGBAAt(2, 2)
+		if got != (color.RGBA{255, 255, 255, 255}) {
+			t.Errorf("resizeToFit() pixel = %v, want white", got)
+		}
+	})
+}
+
+func TestApplyOrientation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	marker := color.RGBA{R: 255, A: 255}
+	img.SetRGBA(0, 0, marker)
+
+	rotated := applyOrientation(img, 6)
+	if size := rotated.Bounds().Size(); size != image.Pt(2, 4) {
+		t.Fatalf("rotated size = %v, want (2,4)", size)
+	}
+	// The top-left corner ends up top-right after a clockwise turn
+	if got := rotated.RGBAAt(1, 0); got != marker {
+		t.Errorf("rotated pixel = %v, want %v", got, marker)
+	}
+
+	if got := applyOrientation(img, 1); got != img {
+		t.Error("orientation 1 should return the image unchanged")
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	ifd := make([]byte, 2+12+4)
+	binary.LittleEndian.PutUint16(ifd[0:], 1)
+	binary.LittleEndian.PutUint16(ifd[2:], tagOrientation)
+	binary.LittleEndian.PutUint16(ifd[4:], 3) // SHORT
+	binary.LittleEndian.PutUint32(ifd[6:], 1)
+	binary.LittleEndian.PutUint16(ifd[10:], 6)
+	tiff = append(tiff, ifd...)
+
+	if got := exifOrientation(tiff); got != 6 {
+		t.Errorf("exifOrientation() = %d, want 6", got)
+	}
+	if got := exifOrientation([]byte("not a tiff")); got != 1 {
+		t.Errorf("exifOrientation() on garbage = %d, want 1", got)
+	}
+}
+
+func TestCaptureBuffer(t *testing.T) {
+	b := newCaptureBuffer(8)
+	b.Write([]byte("12345"))
+	if got := string(b.Bytes()); got != "12345" {
+		t.Errorf("Bytes() = %q, want %q", got, "12345")
+	}
+
+	if n, err := b.Write([]byte("6789")); n != 4 || err != nil {
+		t.Errorf("Write() = %d, %v; want 4, nil", n, err)
+	}
+	if b.Bytes() != nil {
+		t.Error("Bytes() should be nil after the limit is exceeded")
+	}
+}
+
+func TestProcessUploadCreatesThumbnail(t *testing.T) {
+	photo := encodeTestPNG(t, 400, 200)
+	driveService := newMockDriveService()
+	config := newTestConfig()
+	config.ThumbnailSize = 100
+
+	pipeline := newTestPipeline(&mockBlobAPI{content: photo}, driveService, config)
+	pipeline.settings.defaults = GroupSettings{Thumbnails: true}
+	pipeline.contactSheets = NewContactSheets(t.TempDir())
+
+	job := UploadJob{MessageID: "img-1", Type: "image", GroupID: "group-1"}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+
+	files := driveService.files
+	thumbIndex := -1
+	sawFolder := false
+	for i, f := range files.created {
+		if f.Name == thumbnailFolderName && f.MimeType == folderMimeType {
+			sawFolder = true
+		}
+		if strings.HasSuffix(f.Name, "-thumb.jpg") {
+			thumbIndex = i
+		}
+	}
+	if !sawFolder {
+		t.Error("Thumbnails folder was not created")
+	}
+	if thumbIndex < 0 {
+		t.Fatal("no thumbnail was uploaded")
+	}
+	if want := "line-file-"; !strings.HasPrefix(files.created[thumbIndex].Name, want) {
+		t.Errorf("thumbnail name = %q, want prefix %q", files.created[thumbIndex].Name, want)
+	}
+
+	// Folders are created without content, so find the thumbnail's upload
+	thumb, err := jpeg.Decode(bytes.NewReader(files.uploaded[len(files.uploaded)-1]))
+	if err != nil {
+		t.Fatalf("thumbnail is not a JPEG: %v", err)
+	}
+	if size := thumb.Bounds().Size(); size != image.Pt(100, 50) {
+		t.Errorf("thumbnail size = %v, want (100,50)", size)
+	}
+
+	days, err := pipeline.contactSheets.Pending(time.Now().AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("Pending() error: %v", err)
+	}
+	if len(days) != 1 {
+		t.Errorf("Pending() returned %d days, want 1", len(days))
+	}
+}
+
+func TestProcessUploadWithoutThumbnails(t *testing.T) {
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{content: encodeTestPNG(t, 10, 10)}, driveService, newTestConfig())
+
+	job := UploadJob{MessageID: "img-1", Type: "image"}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+	if len(driveService.files.created) != 1 {
+		t.Errorf("created %d files, want only the photo", len(driveService.files.created))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+const maxTranscodeAttempts = 10
+
+// Variables rather than constants so tests can shorten them
+var (
+	transcodePollInterval    = time.Second
+	transcodeMaxPollInterval = 10 * time.Second
+	// transcodeRetryDelay is how long a job that is still transcoding waits
+	// before it is tried again
+	transcodeRetryDelay = 2 * time.Minute
+)
+
+var errTranscodingPending = errors.New("content is still being transcoded")
+
+// needsTranscoding reports whether LINE prepares the content before it can
+// be downloaded, which is the case for videos and audio stored on LINE.
+func needsTranscoding(message webhook.MessageContentInterface) bool {
+	switch message.(type) {
+	case webhook.VideoMessageContent, webhook.AudioMessageContent:
+		return externalContentURL(message) == ""
+	}
+	return false
+}
+
+// waitForTranscoding polls LINE until the content of a video or audio
+// message is ready, for at most Config.TranscodeWait. It returns
+// errTranscodingPending if the content is still not ready by then.
+func (p *Pipeline) waitForTranscoding(ctx context.Context, messageID string) error {
+	deadline := time.Now().Add(p.config.TranscodeWait)
+	interval := transcodePollInterval
+
+	for {
+		status, err := p.blob.GetTranscodingStatus(ctx, messageID)
+		if err != nil {
+			return fmt.Errorf("failed to get transcoding status: %v", err)
+		}
+		switch status {
+		case "succeeded":
+			return nil
+		case "failed":
+			return fmt.Errorf("LINE failed to prepare the content of message %s", messageID)
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return errTranscodingPending
+		}
+		log.Printf("Content of message %s is %s, checking again in %v", messageID, status, interval)
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		interval = min(interval*2, transcodeMaxPollInterval)
+	}
+}
+
+// runUpload processes a tracked job and settles it with the tracker: the job
+// is either finished or, while LINE is still transcoding, retried later.
+func (p *Pipeline) runUpload(ctx context.Context, job UploadJob, replyToken string, receipts *Receipts) {
+	err := p.processUpload(ctx, job, replyToken, receipts)
+	if errors.Is(err, errTranscodingPending) {
+		retrying := p.retryLater(ctx, job)
+		// Later attempts only report how it ended
+		if retrying && replyToken != "" {
+			receipts.Note(job, replyToken, localize(msgNoteProcessing, jobName(job)))
+		} else if !retrying {
+			receipts.Note(job, replyToken, localize(msgNoteGaveUp, jobName(job)))
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Error uploading %s: %v", job.MessageID, err)
+		receipts.Note(job, replyToken, localize(msgNoteFailed, jobName(job), describeUploadError(err)))
+	}
+	p.tracker.Finish(job.MessageID)
+}
+
+// retryLater runs the job again after transcodeRetryDelay and tells the chat
+// how it went. A shutdown in the meantime leaves the job pending, so it is
+// saved and retried on the next start. It reports false when the job is
+// given up on instead.
+func (p *Pipeline) retryLater(ctx context.Context, job UploadJob) bool {
+	job.Attempts++
+	if job.Attempts > maxTranscodeAttempts {
+		log.Printf("Giving up on %s: still transcoding after %d attempts", job.MessageID, maxTranscodeAttempts)
+		p.tracker.Finish(job.MessageID)
+		return false
+	}
+	if !p.tracker.Requeue(job) {
+		return true
+	}
+
+	log.Printf("Content of %s is not ready yet, retrying in %v", job.MessageID, transcodeRetryDelay)
+	go func() {
+		defer p.tracker.Done([]UploadJob{job})
+
+		timer := time.NewTimer(transcodeRetryDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-p.tracker.Stopping():
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		receipts := NewReceipts()
+		p.runUpload(ctx, job, "", receipts)
+		p.sendReceipts(receipts)
+	}()
+	return true
+}
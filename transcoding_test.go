@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// shortenTranscodeDelays speeds up polling and retries for one test
+func shortenTranscodeDelays(t *testing.T, retry time.Duration) {
+	t.Helper()
+	poll, maxPoll, retryDelay := transcodePollInterval, transcodeMaxPollInterval, transcodeRetryDelay
+	transcodePollInterval, transcodeMaxPollInterval, transcodeRetryDelay = 5*time.Millisecond, 10*time.Millisecond, retry
+	t.Cleanup(func() {
+		transcodePollInterval, transcodeMaxPollInterval, transcodeRetryDelay = poll, maxPoll, retryDelay
+	})
+}
+
+func TestNeedsTranscoding(t *testing.T) {
+	external := &webhook.ContentProvider{
+		Type:               webhook.ContentProviderTYPE_EXTERNAL,
+		OriginalContentUrl: "https://example.com/v.mp4",
+	}
+	tests := []struct {
+		name    string
+		message webhook.MessageContentInterface
+		want    bool
+	}{
+		{"video", webhook.VideoMessageContent{Id: "v"}, true},
+		{"audio", webhook.AudioMessageContent{Id: "a"}, true},
+		{"image", webhook.ImageMessageContent{Id: "i"}, false},
+		{"external video", webhook.VideoMessageContent{Id: "v", ContentProvider: external}, false},
+	}
+	for _, tt := range tests {
+		if got := needsTranscoding(tt.message); got != tt.want {
+			t.Errorf("needsTranscoding(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWaitForTranscoding(t *testing.T) {
+	shortenTranscodeDelays(t, time.Hour)
+
+	tests := []struct {
+		name      string
+		statuses  []string
+		wait      time.Duration
+		wantErr   error
+		wantPolls int
+	}{
+		{"ready after a while", []string{"processing", "processing", "succeeded"}, time.Second, nil, 3},
+		{"still processing", []string{"processing"}, 20 * time.Millisecond, errTranscodingPending, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blob := &mockBlobAPI{statuses: tt.statuses}
+			pipeline := newTestPipeline(blob, newMockDriveService(), &Config{TranscodeWait: tt.wait})
+
+			err := pipeline.waitForTranscoding(context.Background(), "vid-1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("waitForTranscoding() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantPolls > 0 && blob.polls != tt.wantPolls {
+				t.Errorf("polled %d times, want %d", blob.polls, tt.wantPolls)
+			}
+		})
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		blob := &mockBlobAPI{statuses: []string{"failed"}}
+		pipeline := newTestPipeline(blob, newMockDriveService(), &Config{TranscodeWait: time.Second})
+		err := pipeline.waitForTranscoding(context.Background(), "vid-1")
+		if err == nil || errors.Is(err, errTranscodingPending) {
+			t.Errorf("waitForTranscoding() error = %v, want a permanent failure", err)
+		}
+	})
+}
+
+func TestRunUploadRequeuesWhileTranscoding(t *testing.T) {
+	shortenTranscodeDelays(t, time.Hour)
+
+	blob := &mockBlobAPI{content: []byte("video"), statuses: []string{"processing"}}
+	driveService := newMockDriveService()
+	config := newTestConfig()
+	config.TranscodeWait = 10 * time.Millisecond
+	pipeline := newTestPipeline(blob, driveService, config)
+
+	job := UploadJob{MessageID: "vid-1", Type: "video"}
+	batch := []UploadJob{job}
+	pipeline.tracker.Accept(batch)
+	pipeline.runUpload(context.Background(), job, "", nil)
+	pipeline.tracker.Done(batch)
+
+	if len(driveService.files.created) != 0 {
+		t.Fatal("nothing should be uploaded while transcoding")
+	}
+
+	// The retry is waiting; shutting down hands the job over for the next start
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	pending := pipeline.tracker.Drain(ctx)
+	if ctx.Err() != nil {
+		t.Error("Drain should not wait for the retry delay")
+	}
+	if len(pending) != 1 || pending[0].MessageID != "vid-1" || pending[0].Attempts != 1 {
+		t.Errorf("Drain() = %+v, want vid-1 after one attempt", pending)
+	}
+}
+
+func TestRunUploadRetriesUntilReady(t *testing.T) {
+	shortenTranscodeDelays(t, 10*time.Millisecond)
+
+	blob := &mockBlobAPI{content: []byte("video"), statuses: []string{"processing", "processing", "succeeded"}}
+	driveService := newMockDriveService()
+	config := newTestConfig()
+	config.TranscodeWait = time.Millisecond
+	pipeline := newTestPipeline(blob, driveService, config)
+
+	job := UploadJob{MessageID: "vid-1", Type: "video"}
+	batch := []UploadJob{job}
+	pipeline.tracker.Accept(batch)
+	pipeline.runUpload(context.Background(), job, "", nil)
+	pipeline.tracker.Done(batch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for !pipeline.messageCache.IsProcessed("vid-1") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pending := pipeline.tracker.Drain(ctx); len(pending) != 0 {
+		t.Errorf("Drain() = %+v, want the retried job finished", pending)
+	}
+	if len(driveService.files.created) != 1 {
+		t.Errorf("created %d files, want the video once", len(driveService.files.created))
+	}
+}
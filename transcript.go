@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	transcriptsDir         = "transcripts" // inside Config.StateDir
+	transcriptSyncInterval = 5 * time.Minute
+)
+
+// Transcript formats for the transcript group setting
+const (
+	transcriptMarkdown = "markdown"
+	transcriptJSONL    = "jsonl"
+)
+
+func validateTranscriptFormat(format string) error {
+	switch format {
+	case "", transcriptMarkdown, transcriptJSONL:
+		return nil
+	}
+	return fmt.Errorf("invalid transcript format %q: must be markdown or jsonl", format)
+}
+
+// transcriptEntry is one text message in a transcript
+type transcriptEntry struct {
+	Time      time.Time `json:"time"`
+	MessageID string    `json:"messageId"`
+	SenderID  string    `json:"senderId"`
+	Sender    string    `json:"sender"`
+	Text      string    `json:"text"`
+}
+
+// transcriptName names a chat's transcript for a day
+func transcriptName(day time.Time, format string) string {
+	ext := ".md"
+	if format == transcriptJSONL {
+		ext = ".jsonl"
+	}
+	return "transcript-" + day.Format(contactSheetDayLayout) + ext
+}
+
+// formatTranscriptEntry renders an entry as it appears in a transcript
+func formatTranscriptEntry(entry transcriptEntry, format string) ([]byte, error) {
+	if format == transcriptJSONL {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	}
+	// Indent continuation lines so multi-line messages stay one list item
+	text := strings.ReplaceAll(entry.Text, "\n", "\n  ")
+	return []byte(fmt.Sprintf("- **%s** %s: %s\n", entry.Time.Format("15:04:05"), entry.Sender, text)), nil
+}
+
+// renderTranscript turns the JSON lines kept on disk into the transcript
+// of a day in the format named by the file's extension. Lines written as
+// Markdown by older versions are kept as they are.
+func renderTranscript(name string, data []byte) []byte {
+	if filepath.Ext(name) == ".jsonl" {
+		return data
+	}
+	var out bytes.Buffer
+	if !bytes.HasPrefix(data, []byte("#")) {
+		date := strings.TrimSuffix(strings.TrimPrefix(name, "transcript-"), filepath.Ext(name))
+		out.WriteString("# Transcript " + date + "\n\n")
+	}
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var entry transcriptEntry
+		if json.Unmarshal(line, &entry) != nil {
+			out.Write(line)
+			continue
+		}
+		text, _ := formatTranscriptEntry(entry, transcriptMarkdown)
+		out.Write(text)
+	}
+	return out.Bytes()
+}
+
+// Transcripts collects the text messages of each chat in daily files on
+// disk, which are copied to the chat's folder now and then. Keeping them on
+// disk lets a day survive restarts, and keeping them as JSON lines whatever
+// the format lets an unsent message be found again.
+//
+// Layout: <dir>/<chat folder ID>/transcript-<YYYY-MM-DD>.<md|jsonl>
+type Transcripts struct {
+	mu     sync.Mutex
+	dir    string
+	synced map[string]time.Time // path -> modification time last uploaded
+}
+
+func NewTranscripts(dir string) *Transcripts {
+	return &Transcripts{
+		dir:    dir,
+		synced: make(map[string]time.Time),
+	}
+}
+
+// transcriptFile is the transcript of one chat for one day
+type transcriptFile struct {
+	FolderID string
+	Name     string
+	Day      time.Time
+}
+
+// Append adds an entry to the day's transcript of the chat whose folder is
+// folderID.
+func (t *Transcripts) Append(folderID string, entry transcriptEntry, format string) error {
+	data, err := formatTranscriptEntry(entry, transcriptJSONL)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dir := filepath.Join(t.dir, folderID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, transcriptName(entry.Time, format))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Changed returns the transcripts written to since they were last uploaded
+func (t *Transcripts) Changed() ([]transcriptFile, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	folders, err := os.ReadDir(t.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []transcriptFile
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(t.dir, folder.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(t.dir, folder.Name(), entry.Name())
+			if synced, ok := t.synced[path]; ok && !info.ModTime().After(synced) {
+				continue
+			}
+			date := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), "transcript-"), filepath.Ext(entry.Name()))
+			day, err := time.ParseInLocation(contactSheetDayLayout, date, time.Local)
+			if err != nil {
+				continue
+			}
+			files = append(files, transcriptFile{FolderID: folder.Name(), Name: entry.Name(), Day: day})
+		}
+	}
+	return files, nil
+}
+
+// Read returns the content of a transcript and the modification time it
+// corresponds to, to pass to MarkSynced once uploaded.
+func (t *Transcripts) Read(file transcriptFile) ([]byte, time.Time, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	path := t.path(file)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return renderTranscript(file.Name, data), info.ModTime(), nil
+}
+
+// RemoveMessage drops the entry of messageID from the transcripts still on
+// disk. A rewritten transcript counts as changed, so the next sync replaces
+// its copy in Drive.
+func (t *Transcripts) RemoveMessage(messageID string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(t.dir, "*", "transcript-*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var kept []byte
+		for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+			var entry transcriptEntry
+			if json.Unmarshal(line, &entry) == nil && entry.MessageID == messageID {
+				continue
+			}
+			kept = append(kept, line...)
+		}
+		if len(kept) == len(data) {
+			continue
+		}
+		if err := os.WriteFile(path, kept, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkSynced records an upload. Transcripts of days before now are done and
+// removed unless they changed during the upload.
+func (t *Transcripts) MarkSynced(file transcriptFile, modTime, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	path := t.path(file)
+	t.synced[path] = modTime
+	if file.Day.Format(contactSheetDayLayout) >= now.Format(contactSheetDayLayout) {
+		return nil
+	}
+	if info, err := os.Stat(path); err != nil || info.ModTime().After(modTime) {
+		return err
+	}
+	delete(t.synced, path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	// Drop the chat directory once it is empty; a failure just means it is not
+	os.Remove(filepath.Join(t.dir, file.FolderID))
+	return nil
+}
+
+func (t *Transcripts) path(file transcriptFile) string {
+	return filepath.Join(t.dir, file.FolderID, file.Name)
+}
+
+// recordText appends a text message to its chat's transcript when the chat
+// has transcripts enabled. Only groups and rooms have transcripts.
+func (p *Pipeline) recordText(messageID, text, userID, groupID string, sent time.Time) {
+	settings := p.settings.ForGroup(groupID)
+	if groupID == "" || settings.Transcript == "" || p.transcripts == nil {
+		return
+	}
+
+	folderID, err := p.chatFolder(userID, groupID)
+	if err != nil {
+		log.Printf("Error resolving folder for transcript of %s: %v", groupID, err)
+		return
+	}
+	entry := transcriptEntry{
+		Time:      sent,
+		MessageID: messageID,
+		SenderID:  userID,
+		Sender:    p.lookupNames(userID, groupID).Sender,
+		Text:      text,
+	}
+	if err := p.transcripts.Append(folderID, entry, settings.Transcript); err != nil {
+		log.Printf("Error appending to transcript of %s: %v", groupID, err)
+	}
+}
+
+// syncTranscripts uploads the transcripts that changed since the last sync,
+// replacing the previous copy in the chat's folder.
+func (p *Pipeline) syncTranscripts(now time.Time) error {
+	files, err := p.transcripts.Changed()
+	if err != nil {
+		return fmt.Errorf("failed to list transcripts: %v", err)
+	}
+
+	for _, file := range files {
+		data, modTime, err := p.transcripts.Read(file)
+		if err != nil {
+			return fmt.Errorf("failed to read transcript: %v", err)
+		}
+
+		if err := p.replaceFile(file.FolderID, file.Name, "text/plain", bytes.NewReader(data)); err != nil {
+			return err
+		}
+		log.Printf("Transcript uploaded: %s", file.Name)
+
+		if err := p.transcripts.MarkSynced(file, modTime, now); err != nil {
+			return fmt.Errorf("failed to clean up transcript: %v", err)
+		}
+	}
+	return nil
+}
+
+// runTranscripts uploads changed transcripts every transcriptSyncInterval
+// and once more when ctx is done.
+func (p *Pipeline) runTranscripts(ctx context.Context) {
+	ticker := time.NewTicker(transcriptSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Whatever does not make it now is uploaded after the restart
+			if err := p.syncTranscripts(time.Now()); err != nil {
+				log.Printf("Error syncing transcripts: %v", err)
+			}
+			return
+		case <-ticker.C:
+		}
+		if err := p.syncTranscripts(time.Now()); err != nil {
+			log.Printf("Error syncing transcripts: %v", err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatTranscriptEntry(t *testing.T) {
+	entry := transcriptEntry{
+		Time:      time.Date(2024, 5, 16, 9, 30, 0, 0, time.Local),
+		MessageID: "msg-1",
+		SenderID:  "user-1",
+		Sender:    "Alice",
+		Text:      "Dinner at 7\nSee you there",
+	}
+
+	markdown, err := formatTranscriptEntry(entry, transcriptMarkdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "- **09:30:00** Alice: Dinner at 7\n  See you there\n"; string(markdown) != want {
+		t.Errorf("markdown = %q, want %q", markdown, want)
+	}
+
+	line, err := formatTranscriptEntry(entry, transcriptJSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded transcriptEntry
+	if err := json.Unmarshal(line, &decoded); err != nil || decoded.Text != entry.Text || decoded.Sender != "Alice" {
+		t.Errorf("jsonl = %q, %v", line, err)
+	}
+}
+
+func TestRecordTextOnlyWhenEnabled(t *testing.T) {
+	dir := t.TempDir()
+	pipeline := newTestPipeline(&mockBlobAPI{}, newMockDriveService(), newTestConfig())
+	pipeline.transcripts = NewTranscripts(dir)
+	pipeline.settings.groups["group-on"] = GroupSettings{Transcript: transcriptMarkdown}
+
+	sent := time.Date(2024, 5, 16, 9, 30, 0, 0, time.Local)
+	pipeline.recordText("msg-1", "hello", "user-1", "group-off", sent)
+	pipeline.recordText("msg-2", "hello", "user-1", "group-on", sent)
+	pipeline.recordText("msg-3", "again", "user-1", "group-on", sent.Add(time.Minute))
+
+	files, err := pipeline.transcripts.Changed()
+	if err != nil {
+		t.Fatalf("Changed() error: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != "transcript-2024-05-16.md" {
+		t.Fatalf("Changed() = %+v, want one transcript for group-on", files)
+	}
+
+	data, _, err := pipeline.transcripts.Read(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "# Transcript 2024-05-16\n\n") || strings.Count(string(data), "user-1: ") != 2 {
+		t.Errorf("transcript = %q, want a header and two messages", data)
+	}
+}
+
+func TestSyncTranscripts(t *testing.T) {
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{}, driveService, newTestConfig())
+	pipeline.transcripts = NewTranscripts(t.TempDir())
+
+	day := time.Date(2024, 5, 16, 9, 30, 0, 0, time.Local)
+	entry := transcriptEntry{Time: day, Sender: "Alice", Text: "hi"}
+	if err := pipeline.transcripts.Append("group-folder", entry, transcriptJSONL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Still the same day: uploaded but kept for more messages
+	if err := pipeline.syncTranscripts(day); err != nil {
+		t.Fatalf("syncTranscripts() error: %v", err)
+	}
+	files := driveService.files
+	if len(files.created) != 1 || files.created[0].Name != "transcript-2024-05-16.jsonl" {
+		t.Fatalf("created %v, want the transcript", files.created)
+	}
+	if changed, _ := pipeline.transcripts.Changed(); len(changed) != 0 {
+		t.Errorf("Changed() after sync = %+v, want none", changed)
+	}
+
+	// A later message replaces the copy in Drive
+	time.Sleep(10 * time.Millisecond)
+	if err := pipeline.transcripts.Append("group-folder", entry, transcriptJSONL); err != nil {
+		t.Fatal(err)
+	}
+	files.existing = files.created
+	if err := pipeline.syncTranscripts(day.AddDate(0, 0, 1)); err != nil {
+		t.Fatalf("syncTranscripts() error: %v", err)
+	}
+	if len(files.updated) != 1 || strings.Count(string(files.uploaded[1]), "\n") != 2 {
+		t.Errorf("updated %v with %q, want the full transcript", files.updated, files.uploaded[len(files.uploaded)-1])
+	}
+
+	// The day is over, so the local copy is gone
+	if changed, _ := pipeline.transcripts.Changed(); len(changed) != 0 {
+		t.Errorf("Changed() after the day ended = %+v, want none", changed)
+	}
+}
+
+func TestRemoveMessageFromTranscript(t *testing.T) {
+	transcripts := NewTranscripts(t.TempDir())
+	day := time.Date(2024, 5, 16, 9, 30, 0, 0, time.Local)
+	for _, id := range []string{"msg-1", "msg-2"} {
+		entry := transcriptEntry{Time: day, MessageID: id, Sender: "Alice", Text: "text of " + id}
+		if err := transcripts.Append("group-folder", entry, transcriptMarkdown); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := transcriptFile{FolderID: "group-folder", Name: "transcript-2024-05-16.md", Day: day}
+	_, modTime, err := transcripts.Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := transcripts.MarkSynced(file, modTime, day); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := transcripts.RemoveMessage("msg-1"); err != nil {
+		t.Fatalf("RemoveMessage() error: %v", err)
+	}
+	data, _, err := transcripts.Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# Transcript 2024-05-16\n\n- **09:30:00** Alice: text of msg-2\n"; string(data) != want {
+		t.Errorf("transcript = %q, want %q", data, want)
+	}
+	if changed, _ := transcripts.Changed(); len(changed) != 1 {
+		t.Errorf("Changed() = %+v, want the transcript synced again", changed)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// lineMessageIDProperty is the appProperties key holding the LINE message
+// an archived file came from
+const lineMessageIDProperty = "lineMessageId"
+
+// filesForMessage finds the archived files of a LINE message. Quarantined
+// files are left out: they stay where admins can inspect them.
+func filesForMessage(driveService DriveService, messageID string) ([]*drive.File, error) {
+	query := fmt.Sprintf("appProperties has { key='%s' and value='%s' } and mimeType != '%s' and trashed = false",
+		lineMessageIDProperty, escapeQueryValue(messageID), folderMimeType)
+	files, err := driveService.Files().ListFiles(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up files of message %s: %v", messageID, err)
+	}
+	// Drive cannot query for a property that merely exists
+	archived := files[:0]
+	for _, file := range files {
+		if file.AppProperties["threat"] == "" {
+			archived = append(archived, file)
+		}
+	}
+	return archived, nil
+}
+
+// handleUnsend removes the archived copy of a message its sender unsent,
+// with its thumbnail: into UNSENT_FOLDER_ID when configured, otherwise into
+// the trash. Its tile is dropped from contact sheets not yet published, its
+// text from the transcripts still on disk, its place from the chat's map
+// and its file from /stats. Groups with keepUnsent keep it.
+func (p *Pipeline) handleUnsend(messageID, groupID string) error {
+	settings := p.settings.ForGroup(groupID)
+	if settings.KeepUnsent {
+		log.Printf("Keeping unsent message %s as configured for %s", messageID, groupID)
+		return nil
+	}
+
+	if p.contactSheets != nil {
+		if err := p.contactSheets.RemoveMessage(messageID); err != nil {
+			log.Printf("Error removing unsent message %s from contact sheets: %v", messageID, err)
+		}
+	}
+	if p.transcripts != nil {
+		if err := p.transcripts.RemoveMessage(messageID); err != nil {
+			log.Printf("Error removing unsent message %s from transcripts: %v", messageID, err)
+		}
+	}
+	if p.places != nil {
+		err := p.places.RemoveMessage(messageID, func(folderID string, places []sharedPlace) error {
+			// A map that was turned off is no longer kept up to date
+			if settings.Locations == "" || settings.Locations == locationsOff {
+				return nil
+			}
+			return p.publishPlaces(folderID, settings.Locations, p.lookupNames("", groupID).Group, places)
+		})
+		if err != nil {
+			log.Printf("Error removing unsent message %s from places: %v", messageID, err)
+		}
+	}
+
+	files, err := filesForMessage(p.drive, messageID)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		// Not archived (yet); make sure a redelivery or retry does not
+		// archive it after all
+		p.messageCache.MarkProcessed(messageID)
+		log.Printf("Unsent message %s has no archived files", messageID)
+		return nil
+	}
+
+	for _, file := range files {
+		if p.config.UnsentFolderID != "" {
+			_, err = p.drive.Files().MoveFile(file.Id, p.config.UnsentFolderID, strings.Join(file.Parents, ","))
+		} else {
+			_, err = p.drive.Files().UpdateFile(file.Id, &drive.File{Trashed: true}, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to remove unsent file %s: %v", file.Name, err)
+		}
+		p.groupCache.RemoveRecentFile(fileURL(file.Id))
+		log.Printf("Removed %s because message %s was unsent", file.Name, messageID)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestHandleFileRecordsMessageID(t *testing.T) {
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{content: []byte("hello")}, driveService, newTestConfig())
+
+	job := UploadJob{MessageID: "msg-42", Type: "file", FileName: "notes.txt"}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+	if got := driveService.files.created[0].AppProperties[lineMessageIDProperty]; got != "msg-42" {
+		t.Errorf("%s = %q, want msg-42", lineMessageIDProperty, got)
+	}
+}
+
+func TestHandleUnsend(t *testing.T) {
+	archived := &drive.File{
+		Id:            "file-1",
+		Name:          "photo.jpg",
+		Parents:       []string{"group-folder"},
+		AppProperties: map[string]string{lineMessageIDProperty: "msg-1"},
+	}
+
+	t.Run("trash by default", func(t *testing.T) {
+		driveService := newMockDriveService()
+		driveService.files.existing = []*drive.File{archived}
+		pipeline := newTestPipeline(&mockBlobAPI{}, driveService, newTestConfig())
+
+		if err := pipeline.handleUnsend("msg-1", "group-1"); err != nil {
+			t.Fatalf("handleUnsend() error: %v", err)
+		}
+		if len(driveService.files.updated) != 1 || driveService.files.updated[0] != "file-1" {
+			t.Errorf("updated %v, want file-1 trashed", driveService.files.updated)
+		}
+	})
+
+	t.Run("move to unsent folder", func(t *testing.T) {
+		driveService := newMockDriveService()
+		driveService.files.existing = []*drive.File{archived}
+		config := newTestConfig()
+		config.UnsentFolderID = "unsent-folder"
+		pipeline := newTestPipeline(&mockBlobAPI{}, driveService, config)
+
+		if err := pipeline.handleUnsend("msg-1", "group-1"); err != nil {
+			t.Fatalf("handleUnsend() error: %v", err)
+		}
+		if len(driveService.files.moved) != 1 || driveService.files.moved[0] != "file-1 -> unsent-folder" {
+			t.Errorf("moved %v, want file-1 in unsent-folder", driveService.files.moved)
+		}
+	})
+
+	t.Run("group opted out", func(t *testing.T) {
+		driveService := newMockDriveService()
+		driveService.files.existing = []*drive.File{archived}
+		pipeline := newTestPipeline(&mockBlobAPI{}, driveService, newTestConfig())
+		pipeline.settings.groups["group-1"] = GroupSettings{KeepUnsent: true}
+
+		if err := pipeline.handleUnsend("msg-1", "group-1"); err != nil {
+			t.Fatalf("handleUnsend() error: %v", err)
+		}
+		if len(driveService.files.updated)+len(driveService.files.moved) != 0 {
+			t.Error("file was removed despite keepUnsent")
+		}
+	})
+
+	t.Run("quarantined", func(t *testing.T) {
+		driveService := newMockDriveService()
+		driveService.files.existing = []*drive.File{{
+			Id:            "file-2",
+			Name:          "invoice.pdf",
+			Parents:       []string{"quarantine-folder"},
+			AppProperties: map[string]string{lineMessageIDProperty: "msg-1", "threat": "Eicar-Test-Signature"},
+		}}
+		config := newTestConfig()
+		config.UnsentFolderID = "unsent-folder"
+		pipeline := newTestPipeline(&mockBlobAPI{}, driveService, config)
+
+		if err := pipeline.handleUnsend("msg-1", "group-1"); err != nil {
+			t.Fatalf("handleUnsend() error: %v", err)
+		}
+		if len(driveService.files.updated)+len(driveService.files.moved) != 0 {
+			t.Errorf("updated %v and moved %v, want the quarantined file left alone",
+				driveService.files.updated, driveService.files.moved)
+		}
+	})
+
+	t.Run("not archived yet", func(t *testing.T) {
+		pipeline := newTestPipeline(&mockBlobAPI{content: []byte("hello")}, newMockDriveService(), newTestConfig())
+
+		if err := pipeline.handleUnsend("msg-2", "group-1"); err != nil {
+			t.Fatalf("handleUnsend() error: %v", err)
+		}
+		if !pipeline.messageCache.IsProcessed("msg-2") {
+			t.Error("unsent message should not be archived later")
+		}
+	})
+}
+
+func TestHandleUnsendRemovesThumbnail(t *testing.T) {
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{content: encodeTestPNG(t, 40, 20)}, driveService, newTestConfig())
+	pipeline.settings.defaults = GroupSettings{Thumbnails: true}
+	pipeline.contactSheets = NewContactSheets(t.TempDir())
+
+	job := UploadJob{MessageID: "img-1", Type: "image", GroupID: "group-1"}
+	if err := pipeline.processUpload(context.Background(), job, "", nil); err != nil {
+		t.Fatalf("processUpload() error: %v", err)
+	}
+	files := driveService.files
+	for _, f := range files.created {
+		if f.AppProperties[lineMessageIDProperty] == "img-1" {
+			files.existing = append(files.existing, f)
+		}
+	}
+	if len(files.existing) != 2 || !strings.HasSuffix(files.existing[1].Name, "-thumb.jpg") {
+		t.Fatalf("tagged %+v, want the photo and its thumbnail", files.existing)
+	}
+
+	if err := pipeline.handleUnsend("img-1", "group-1"); err != nil {
+		t.Fatalf("handleUnsend() error: %v", err)
+	}
+	if len(files.trashed) != 2 {
+		t.Errorf("trashed %v, want the photo and its thumbnail", files.trashed)
+	}
+	days, err := pipeline.contactSheets.Pending(time.Now().AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("Pending() error: %v", err)
+	}
+	for _, day := range days {
+		if sheets, _ := pipeline.contactSheets.Render(day); len(sheets) != 0 {
+			t.Errorf("contact sheet of %s still has the unsent photo", day.FolderID)
+		}
+	}
+}
+
+func TestHandleUnsendForgetsTextPlaceAndStats(t *testing.T) {
+	driveService := newMockDriveService()
+	pipeline := newTestPipeline(&mockBlobAPI{}, driveService, newTestConfig())
+	pipeline.transcripts = NewTranscripts(t.TempDir())
+	pipeline.places = NewPlaces(t.TempDir())
+	pipeline.settings.groups["group-1"] = GroupSettings{Transcript: transcriptJSONL, Locations: locationsGPX}
+
+	sent := time.Date(2024, 5, 16, 9, 30, 0, 0, time.UTC)
+	pipeline.recordText("msg-1", "oops", "user-1", "group-1", sent)
+	pipeline.recordText("msg-2", "hello", "user-1", "group-1", sent)
+	pipeline.recordLocation(webhook.LocationMessageContent{Id: "loc-1", Title: "Home", Latitude: 1, Longitude: 2}, "user-1", "group-1", sent)
+	pipeline.recordLocation(webhook.LocationMessageContent{Id: "loc-2", Title: "Station", Latitude: 3, Longitude: 4}, "user-1", "group-1", sent)
+	files := driveService.files
+	files.existing = []*drive.File{files.created[len(files.created)-1]}
+
+	for _, id := range []string{"msg-1", "loc-1"} {
+		if err := pipeline.handleUnsend(id, "group-1"); err != nil {
+			t.Fatalf("handleUnsend(%s) error: %v", id, err)
+		}
+	}
+
+	changed, err := pipeline.transcripts.Changed()
+	if err != nil || len(changed) != 1 {
+		t.Fatalf("Changed() = %+v, %v, want the transcript", changed, err)
+	}
+	data, _, err := pipeline.transcripts.Read(changed[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "oops") || !strings.Contains(string(data), "hello") {
+		t.Errorf("transcript = %q, want only the message that was kept", data)
+	}
+
+	var gpx gpxFile
+	if err := xml.Unmarshal(files.uploaded[len(files.uploaded)-1], &gpx); err != nil {
+		t.Fatal(err)
+	}
+	if len(gpx.Waypoints) != 1 || gpx.Waypoints[0].Name != "Station" {
+		t.Errorf("waypoints = %+v, want only the place that was kept", gpx.Waypoints)
+	}
+
+	archived := &drive.File{Id: "file-1", Name: "photo.jpg", AppProperties: map[string]string{lineMessageIDProperty: "img-1"}}
+	files.existing = []*drive.File{archived}
+	pipeline.groupCache.AddUploadedFile("group-1", "kept.jpg", fileURL("file-2"))
+	pipeline.groupCache.AddUploadedFile("group-1", archived.Name, fileURL(archived.Id))
+	if err := pipeline.handleUnsend("img-1", "group-1"); err != nil {
+		t.Fatalf("handleUnsend() error: %v", err)
+	}
+	if _, _, recent := pipeline.groupCache.GetStats("group-1"); len(recent) != 1 || recent[0].Name != "kept.jpg" {
+		t.Errorf("recent files = %+v, want only kept.jpg", recent)
+	}
+}